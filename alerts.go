@@ -0,0 +1,629 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sharkone/libtorrent-go"
+)
+
+const (
+	alertRingSize   = 500
+	alertBufferSize = 64
+)
+
+// Alert is a decoded libtorrent alert. Data holds the fields specific to the
+// alert type, ex: *TrackerErrorAlert.
+type Alert struct {
+	Id         int64       `json:"id"`
+	Type       string      `json:"type"`
+	Categories []string    `json:"categories"`
+	Message    string      `json:"message"`
+	InfoHash   string      `json:"info_hash,omitempty"`
+	Time       time.Time   `json:"time"`
+	Data       interface{} `json:"data,omitempty"`
+
+	xtype    int
+	category int
+	handle   libtorrent.Torrent_handle
+}
+
+// Handle is nil for alerts not attached to a torrent.
+func (a *Alert) Handle() libtorrent.Torrent_handle {
+	return a.handle
+}
+
+func (a *Alert) HasCategory(categoryMask int) bool {
+	return a.category&categoryMask != 0
+}
+
+type TrackerErrorAlert struct {
+	URL        string `json:"url"`
+	TimesInRow int    `json:"times_in_row"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+type TrackerWarningAlert struct {
+	URL     string `json:"url"`
+	Warning string `json:"warning"`
+}
+
+type TrackerReplyAlert struct {
+	URL   string `json:"url"`
+	Peers int    `json:"peers"`
+}
+
+type TrackerAnnounceAlert struct {
+	URL   string `json:"url"`
+	Event int    `json:"event"`
+}
+
+type ScrapeFailedAlert struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+type HashFailedAlert struct {
+	PieceIndex int `json:"piece_index"`
+}
+
+type StateChangedAlert struct {
+	State     string `json:"state"`
+	PrevState string `json:"prev_state"`
+}
+
+type PortmapAlert struct {
+	Mapping      int `json:"mapping"`
+	MapType      int `json:"map_type"`
+	ExternalPort int `json:"external_port"`
+}
+
+type PortmapErrorAlert struct {
+	Mapping int    `json:"mapping"`
+	MapType int    `json:"map_type"`
+	Error   string `json:"error"`
+}
+
+type ExternalIpAlert struct {
+	Address string `json:"address"`
+}
+
+type ListenAlert struct {
+	SockType int    `json:"sock_type"`
+	Error    string `json:"error,omitempty"`
+}
+
+type PeerAlert struct {
+	Peer string `json:"peer"`
+}
+
+// BlockAlert is used by the alerts about a single block requested from a
+// peer, ex: block_timeout_alert.
+type BlockAlert struct {
+	Peer       string `json:"peer"`
+	PieceIndex int    `json:"piece_index"`
+	BlockIndex int    `json:"block_index"`
+}
+
+type PeerBlockedAlert struct {
+	Peer   string `json:"peer"`
+	Reason int    `json:"reason"`
+}
+
+type IncomingConnectionAlert struct {
+	Peer       string `json:"peer"`
+	SocketType int    `json:"socket_type"`
+}
+
+type PeerErrorAlert struct {
+	Peer  string `json:"peer"`
+	Error string `json:"error"`
+}
+
+type FileErrorAlert struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// DhtAnnounceAlert is a peer announcing itself to our DHT node, the info hash
+// is usually not one of our torrents.
+type DhtAnnounceAlert struct {
+	Peer     string `json:"peer"`
+	InfoHash string `json:"info_hash"`
+}
+
+type DhtGetPeersAlert struct {
+	InfoHash string `json:"info_hash"`
+}
+
+type DhtErrorAlert struct {
+	Operation int    `json:"operation"`
+	Error     string `json:"error"`
+}
+
+type PerformanceAlert struct {
+	Warning string `json:"warning"`
+}
+
+// ErrorAlert is used by alerts only carrying an error, ex: add_torrent_alert.
+type ErrorAlert struct {
+	Error string `json:"error"`
+}
+
+// SaveResumeDataAlert is only valid while the alert is being dispatched.
+type SaveResumeDataAlert struct {
+	resumeData libtorrent.Entry
+}
+
+var alertCategoryNames = []struct {
+	category int
+	name     string
+}{
+	{int(libtorrent.AlertError_notification), "error"},
+	{int(libtorrent.AlertStorage_notification), "storage"},
+	{int(libtorrent.AlertStatus_notification), "status"},
+	{int(libtorrent.AlertTracker_notification), "tracker"},
+	{int(libtorrent.AlertDht_notification), "dht"},
+	{int(libtorrent.AlertPeer_notification), "peer"},
+	{int(libtorrent.AlertIp_block_notification), "ip_block"},
+	{int(libtorrent.AlertPort_mapping_notification), "port_mapping"},
+	{int(libtorrent.AlertProgress_notification), "progress"},
+	{int(libtorrent.AlertPerformance_warning), "performance"},
+	{int(libtorrent.AlertStats_notification), "stats"},
+	{int(libtorrent.AlertDebug_notification), "debug"},
+}
+
+func getAlertCategoryNames(categoryMask int) []string {
+	result := make([]string, 0)
+	for _, categoryName := range alertCategoryNames {
+		if categoryMask&categoryName.category != 0 {
+			result = append(result, categoryName.name)
+		}
+	}
+	return result
+}
+
+// parseAlertCategories parses comma separated category names, empty means
+// all categories.
+func parseAlertCategories(categories string) (int, error) {
+	if strings.TrimSpace(categories) == "" {
+		return int(libtorrent.AlertAll_categories), nil
+	}
+
+	result := 0
+	for _, name := range strings.Split(categories, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, categoryName := range alertCategoryNames {
+			if categoryName.name == name {
+				result |= categoryName.category
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Unknown alert category %v", name)
+		}
+	}
+	return result, nil
+}
+
+var performanceWarningNames = map[int]string{
+	libtorrent.Performance_alertOutstanding_disk_buffer_limit_reached: "outstanding_disk_buffer_limit_reached",
+	libtorrent.Performance_alertOutstanding_request_limit_reached:     "outstanding_request_limit_reached",
+	libtorrent.Performance_alertUpload_limit_too_low:                  "upload_limit_too_low",
+	libtorrent.Performance_alertDownload_limit_too_low:                "download_limit_too_low",
+	libtorrent.Performance_alertSend_buffer_watermark_too_low:         "send_buffer_watermark_too_low",
+	libtorrent.Performance_alertToo_many_optimistic_unchoke_slots:     "too_many_optimistic_unchoke_slots",
+	libtorrent.Performance_alertToo_high_disk_queue_limit:             "too_high_disk_queue_limit",
+	libtorrent.Performance_alertToo_few_outgoing_ports:                "too_few_outgoing_ports",
+	libtorrent.Performance_alertToo_few_file_descriptors:              "too_few_file_descriptors",
+}
+
+func getPerformanceWarningName(warningCode int) string {
+	if name, ok := performanceWarningNames[warningCode]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%v", warningCode)
+}
+
+func getErrorCodeMessage(ec libtorrent.Error_code) string {
+	if ec == nil || ec.Swigcptr() == 0 {
+		return ""
+	}
+	return ec.Message()
+}
+
+func decodeAlert(alert libtorrent.Alert) *Alert {
+	result := &Alert{
+		Type:       alert.What(),
+		Categories: getAlertCategoryNames(alert.Category()),
+		Message:    alert.Message(),
+		Time:       time.Now(),
+		xtype:      alert.Xtype(),
+		category:   alert.Category(),
+	}
+
+	switch alert.Xtype() {
+	case libtorrent.Torrent_added_alertAlert_type:
+		result.handle = libtorrent.SwigcptrTorrent_added_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.Metadata_received_alertAlert_type:
+		result.handle = libtorrent.SwigcptrMetadata_received_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.Metadata_failed_alertAlert_type:
+		metadataFailedAlert := libtorrent.SwigcptrMetadata_failed_alert(alert.Swigcptr())
+		result.handle = metadataFailedAlert.GetHandle()
+		result.Data = &ErrorAlert{Error: getErrorCodeMessage(metadataFailedAlert.GetError())}
+	case libtorrent.Torrent_paused_alertAlert_type:
+		result.handle = libtorrent.SwigcptrTorrent_paused_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.Torrent_resumed_alertAlert_type:
+		result.handle = libtorrent.SwigcptrTorrent_resumed_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.Torrent_finished_alertAlert_type:
+		result.handle = libtorrent.SwigcptrTorrent_finished_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.Torrent_removed_alertAlert_type:
+		result.handle = libtorrent.SwigcptrTorrent_removed_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.Torrent_deleted_alertAlert_type:
+		// The handle is already invalid
+		torrentDeletedAlert := libtorrent.SwigcptrTorrent_deleted_alert(alert.Swigcptr())
+		result.InfoHash = fmt.Sprintf("%X", torrentDeletedAlert.GetInfo_hash().To_string())
+	case libtorrent.Torrent_delete_failed_alertAlert_type:
+		torrentDeleteFailedAlert := libtorrent.SwigcptrTorrent_delete_failed_alert(alert.Swigcptr())
+		result.InfoHash = fmt.Sprintf("%X", torrentDeleteFailedAlert.GetInfo_hash().To_string())
+		result.Data = &ErrorAlert{Error: getErrorCodeMessage(torrentDeleteFailedAlert.GetError())}
+	case libtorrent.Torrent_checked_alertAlert_type:
+		result.handle = libtorrent.SwigcptrTorrent_checked_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.Torrent_error_alertAlert_type:
+		torrentErrorAlert := libtorrent.SwigcptrTorrent_error_alert(alert.Swigcptr())
+		result.handle = torrentErrorAlert.GetHandle()
+		result.Data = &ErrorAlert{Error: getErrorCodeMessage(torrentErrorAlert.GetError())}
+	case libtorrent.Add_torrent_alertAlert_type:
+		addTorrentAlert := libtorrent.SwigcptrAdd_torrent_alert(alert.Swigcptr())
+		result.Data = &ErrorAlert{Error: getErrorCodeMessage(addTorrentAlert.GetError())}
+		if result.Data.(*ErrorAlert).Error == "" {
+			result.handle = addTorrentAlert.GetHandle()
+		} else {
+			// The handle is invalid, the info hash is only set for magnet links
+			if infoHash := addTorrentAlert.GetParams().GetInfo_hash(); !infoHash.Is_all_zeros() {
+				result.InfoHash = fmt.Sprintf("%X", infoHash.To_string())
+			}
+		}
+	case libtorrent.State_changed_alertAlert_type:
+		stateChangedAlert := libtorrent.SwigcptrState_changed_alert(alert.Swigcptr())
+		result.handle = stateChangedAlert.GetHandle()
+		result.Data = &StateChangedAlert{State: getTorrentStateStr(stateChangedAlert.GetState()), PrevState: getTorrentStateStr(stateChangedAlert.GetPrev_state())}
+	case libtorrent.Hash_failed_alertAlert_type:
+		hashFailedAlert := libtorrent.SwigcptrHash_failed_alert(alert.Swigcptr())
+		result.handle = hashFailedAlert.GetHandle()
+		result.Data = &HashFailedAlert{PieceIndex: hashFailedAlert.GetPiece_index()}
+	case libtorrent.Cache_flushed_alertAlert_type:
+		result.handle = libtorrent.SwigcptrCache_flushed_alert(alert.Swigcptr()).GetHandle()
+	case libtorrent.File_error_alertAlert_type:
+		fileErrorAlert := libtorrent.SwigcptrFile_error_alert(alert.Swigcptr())
+		result.handle = fileErrorAlert.GetHandle()
+		result.Data = &FileErrorAlert{File: fileErrorAlert.GetFile(), Error: getErrorCodeMessage(fileErrorAlert.GetError())}
+	case libtorrent.Fastresume_rejected_alertAlert_type:
+		fastresumeRejectedAlert := libtorrent.SwigcptrFastresume_rejected_alert(alert.Swigcptr())
+		result.handle = fastresumeRejectedAlert.GetHandle()
+		result.Data = &ErrorAlert{Error: getErrorCodeMessage(fastresumeRejectedAlert.GetError())}
+	case libtorrent.Save_resume_data_alertAlert_type:
+		saveResumeDataAlert := libtorrent.SwigcptrSave_resume_data_alert(alert.Swigcptr())
+		result.handle = saveResumeDataAlert.GetHandle()
+		result.Data = &SaveResumeDataAlert{resumeData: saveResumeDataAlert.GetResume_data()}
+	case libtorrent.Save_resume_data_failed_alertAlert_type:
+		saveResumeDataFailedAlert := libtorrent.SwigcptrSave_resume_data_failed_alert(alert.Swigcptr())
+		result.handle = saveResumeDataFailedAlert.GetHandle()
+		result.Data = &ErrorAlert{Error: getErrorCodeMessage(saveResumeDataFailedAlert.GetError())}
+	case libtorrent.Tracker_error_alertAlert_type:
+		trackerErrorAlert := libtorrent.SwigcptrTracker_error_alert(alert.Swigcptr())
+		result.handle = trackerErrorAlert.GetHandle()
+		result.Data = &TrackerErrorAlert{
+			URL:        trackerErrorAlert.GetUrl(),
+			TimesInRow: trackerErrorAlert.GetTimes_in_row(),
+			StatusCode: trackerErrorAlert.GetStatus_code(),
+			Error:      getErrorCodeMessage(trackerErrorAlert.GetError()),
+		}
+	case libtorrent.Tracker_warning_alertAlert_type:
+		trackerWarningAlert := libtorrent.SwigcptrTracker_warning_alert(alert.Swigcptr())
+		result.handle = trackerWarningAlert.GetHandle()
+		result.Data = &TrackerWarningAlert{URL: trackerWarningAlert.GetUrl(), Warning: trackerWarningAlert.GetMsg()}
+	case libtorrent.Tracker_reply_alertAlert_type:
+		trackerReplyAlert := libtorrent.SwigcptrTracker_reply_alert(alert.Swigcptr())
+		result.handle = trackerReplyAlert.GetHandle()
+		result.Data = &TrackerReplyAlert{URL: trackerReplyAlert.GetUrl(), Peers: trackerReplyAlert.GetNum_peers()}
+	case libtorrent.Tracker_announce_alertAlert_type:
+		trackerAnnounceAlert := libtorrent.SwigcptrTracker_announce_alert(alert.Swigcptr())
+		result.handle = trackerAnnounceAlert.GetHandle()
+		result.Data = &TrackerAnnounceAlert{URL: trackerAnnounceAlert.GetUrl(), Event: trackerAnnounceAlert.GetEvent()}
+	case libtorrent.Scrape_failed_alertAlert_type:
+		scrapeFailedAlert := libtorrent.SwigcptrScrape_failed_alert(alert.Swigcptr())
+		result.handle = scrapeFailedAlert.GetHandle()
+		result.Data = &ScrapeFailedAlert{URL: scrapeFailedAlert.GetUrl(), Error: scrapeFailedAlert.GetMsg()}
+	case libtorrent.Portmap_alertAlert_type:
+		portmapAlert := libtorrent.SwigcptrPortmap_alert(alert.Swigcptr())
+		result.Data = &PortmapAlert{Mapping: portmapAlert.GetMapping(), MapType: portmapAlert.GetMap_type(), ExternalPort: portmapAlert.GetExternal_port()}
+	case libtorrent.Portmap_error_alertAlert_type:
+		portmapErrorAlert := libtorrent.SwigcptrPortmap_error_alert(alert.Swigcptr())
+		result.Data = &PortmapErrorAlert{Mapping: portmapErrorAlert.GetMapping(), MapType: portmapErrorAlert.GetMap_type(), Error: getErrorCodeMessage(portmapErrorAlert.GetError())}
+	case libtorrent.External_ip_alertAlert_type:
+		externalIpAlert := libtorrent.SwigcptrExternal_ip_alert(alert.Swigcptr())
+		result.Data = &ExternalIpAlert{Address: externalIpAlert.GetExternal_address().To_string()}
+	case libtorrent.Listen_succeeded_alertAlert_type:
+		listenSucceededAlert := libtorrent.SwigcptrListen_succeeded_alert(alert.Swigcptr())
+		result.Data = &ListenAlert{SockType: int(listenSucceededAlert.GetSock_type())}
+	case libtorrent.Listen_failed_alertAlert_type:
+		listenFailedAlert := libtorrent.SwigcptrListen_failed_alert(alert.Swigcptr())
+		result.Data = &ListenAlert{SockType: int(listenFailedAlert.GetSock_type()), Error: getErrorCodeMessage(listenFailedAlert.GetError())}
+	case libtorrent.Peer_error_alertAlert_type:
+		peerErrorAlert := libtorrent.SwigcptrPeer_error_alert(alert.Swigcptr())
+		result.handle = peerErrorAlert.GetHandle()
+		result.Data = &PeerErrorAlert{Peer: peerErrorAlert.GetIp().Address().To_string(), Error: getErrorCodeMessage(peerErrorAlert.GetError())}
+	case libtorrent.Peer_connect_alertAlert_type:
+		peerConnectAlert := libtorrent.SwigcptrPeer_connect_alert(alert.Swigcptr())
+		result.handle = peerConnectAlert.GetHandle()
+		result.Data = &PeerAlert{Peer: peerConnectAlert.GetIp().Address().To_string()}
+	case libtorrent.Peer_disconnected_alertAlert_type:
+		peerDisconnectedAlert := libtorrent.SwigcptrPeer_disconnected_alert(alert.Swigcptr())
+		result.handle = peerDisconnectedAlert.GetHandle()
+		result.Data = &PeerErrorAlert{Peer: peerDisconnectedAlert.GetIp().Address().To_string(), Error: getErrorCodeMessage(peerDisconnectedAlert.GetError())}
+	case libtorrent.Peer_ban_alertAlert_type:
+		peerBanAlert := libtorrent.SwigcptrPeer_ban_alert(alert.Swigcptr())
+		result.handle = peerBanAlert.GetHandle()
+		result.Data = &PeerAlert{Peer: peerBanAlert.GetIp().Address().To_string()}
+	case libtorrent.Peer_snubbed_alertAlert_type:
+		peerSnubbedAlert := libtorrent.SwigcptrPeer_snubbed_alert(alert.Swigcptr())
+		result.handle = peerSnubbedAlert.GetHandle()
+		result.Data = &PeerAlert{Peer: peerSnubbedAlert.GetIp().Address().To_string()}
+	case libtorrent.Peer_unsnubbed_alertAlert_type:
+		peerUnsnubbedAlert := libtorrent.SwigcptrPeer_unsnubbed_alert(alert.Swigcptr())
+		result.handle = peerUnsnubbedAlert.GetHandle()
+		result.Data = &PeerAlert{Peer: peerUnsnubbedAlert.GetIp().Address().To_string()}
+	case libtorrent.Invalid_request_alertAlert_type:
+		invalidRequestAlert := libtorrent.SwigcptrInvalid_request_alert(alert.Swigcptr())
+		result.handle = invalidRequestAlert.GetHandle()
+		result.Data = &PeerAlert{Peer: invalidRequestAlert.GetIp().Address().To_string()}
+	case libtorrent.Lsd_peer_alertAlert_type:
+		lsdPeerAlert := libtorrent.SwigcptrLsd_peer_alert(alert.Swigcptr())
+		result.handle = lsdPeerAlert.GetHandle()
+		result.Data = &PeerAlert{Peer: lsdPeerAlert.GetIp().Address().To_string()}
+	case libtorrent.Request_dropped_alertAlert_type:
+		requestDroppedAlert := libtorrent.SwigcptrRequest_dropped_alert(alert.Swigcptr())
+		result.handle = requestDroppedAlert.GetHandle()
+		result.Data = &BlockAlert{Peer: requestDroppedAlert.GetIp().Address().To_string(), PieceIndex: requestDroppedAlert.GetPiece_index(), BlockIndex: requestDroppedAlert.GetBlock_index()}
+	case libtorrent.Block_timeout_alertAlert_type:
+		blockTimeoutAlert := libtorrent.SwigcptrBlock_timeout_alert(alert.Swigcptr())
+		result.handle = blockTimeoutAlert.GetHandle()
+		result.Data = &BlockAlert{Peer: blockTimeoutAlert.GetIp().Address().To_string(), PieceIndex: blockTimeoutAlert.GetPiece_index(), BlockIndex: blockTimeoutAlert.GetBlock_index()}
+	case libtorrent.Block_finished_alertAlert_type:
+		blockFinishedAlert := libtorrent.SwigcptrBlock_finished_alert(alert.Swigcptr())
+		result.handle = blockFinishedAlert.GetHandle()
+		result.Data = &BlockAlert{Peer: blockFinishedAlert.GetIp().Address().To_string(), PieceIndex: blockFinishedAlert.GetPiece_index(), BlockIndex: blockFinishedAlert.GetBlock_index()}
+	case libtorrent.Block_downloading_alertAlert_type:
+		blockDownloadingAlert := libtorrent.SwigcptrBlock_downloading_alert(alert.Swigcptr())
+		result.handle = blockDownloadingAlert.GetHandle()
+		result.Data = &BlockAlert{Peer: blockDownloadingAlert.GetIp().Address().To_string(), PieceIndex: blockDownloadingAlert.GetPiece_index(), BlockIndex: blockDownloadingAlert.GetBlock_index()}
+	case libtorrent.Unwanted_block_alertAlert_type:
+		unwantedBlockAlert := libtorrent.SwigcptrUnwanted_block_alert(alert.Swigcptr())
+		result.handle = unwantedBlockAlert.GetHandle()
+		result.Data = &BlockAlert{Peer: unwantedBlockAlert.GetIp().Address().To_string(), PieceIndex: unwantedBlockAlert.GetPiece_index(), BlockIndex: unwantedBlockAlert.GetBlock_index()}
+	case libtorrent.Peer_blocked_alertAlert_type:
+		peerBlockedAlert := libtorrent.SwigcptrPeer_blocked_alert(alert.Swigcptr())
+		result.handle = peerBlockedAlert.GetHandle()
+		result.Data = &PeerBlockedAlert{Peer: peerBlockedAlert.GetIp().To_string(), Reason: peerBlockedAlert.GetReason()}
+	case libtorrent.Incoming_connection_alertAlert_type:
+		incomingConnectionAlert := libtorrent.SwigcptrIncoming_connection_alert(alert.Swigcptr())
+		result.Data = &IncomingConnectionAlert{Peer: incomingConnectionAlert.GetIp().Address().To_string(), SocketType: incomingConnectionAlert.GetSocket_type()}
+	case libtorrent.Dht_reply_alertAlert_type:
+		dhtReplyAlert := libtorrent.SwigcptrDht_reply_alert(alert.Swigcptr())
+		result.handle = dhtReplyAlert.GetHandle()
+		result.Data = &TrackerReplyAlert{URL: dhtReplyAlert.GetUrl(), Peers: dhtReplyAlert.GetNum_peers()}
+	case libtorrent.Dht_announce_alertAlert_type:
+		dhtAnnounceAlert := libtorrent.SwigcptrDht_announce_alert(alert.Swigcptr())
+		result.Data = &DhtAnnounceAlert{
+			Peer:     fmt.Sprintf("%v:%v", dhtAnnounceAlert.GetIp().To_string(), dhtAnnounceAlert.GetPort()),
+			InfoHash: fmt.Sprintf("%X", dhtAnnounceAlert.GetInfo_hash().To_string()),
+		}
+	case libtorrent.Dht_get_peers_alertAlert_type:
+		dhtGetPeersAlert := libtorrent.SwigcptrDht_get_peers_alert(alert.Swigcptr())
+		result.Data = &DhtGetPeersAlert{InfoHash: fmt.Sprintf("%X", dhtGetPeersAlert.GetInfo_hash().To_string())}
+	case libtorrent.Dht_bootstrap_alertAlert_type:
+		// Carries nothing but the message
+	case libtorrent.Dht_error_alertAlert_type:
+		dhtErrorAlert := libtorrent.SwigcptrDht_error_alert(alert.Swigcptr())
+		result.Data = &DhtErrorAlert{Operation: dhtErrorAlert.GetOperation(), Error: getErrorCodeMessage(dhtErrorAlert.GetError())}
+	case libtorrent.Performance_alertAlert_type:
+		performanceAlert := libtorrent.SwigcptrPerformance_alert(alert.Swigcptr())
+		result.handle = performanceAlert.GetHandle()
+		result.Data = &PerformanceAlert{Warning: getPerformanceWarningName(performanceAlert.GetWarning_code())}
+	case libtorrent.Udp_error_alertAlert_type:
+		udpErrorAlert := libtorrent.SwigcptrUdp_error_alert(alert.Swigcptr())
+		result.Data = &ErrorAlert{Error: getErrorCodeMessage(udpErrorAlert.GetError())}
+	}
+
+	if result.handle != nil && result.InfoHash == "" {
+		result.InfoHash = fmt.Sprintf("%X", result.handle.Info_hash().To_string())
+	}
+	return result
+}
+
+type AlertHandler func(alert *Alert)
+
+type alertCategoryHandler struct {
+	categoryMask int
+	handler      AlertHandler
+}
+
+// AlertDispatcher hands decoded alerts to the components interested in them.
+// Handlers run on the alert pump and must not block, subscribers get alerts
+// through a channel and miss them when too slow.
+type AlertDispatcher struct {
+	mutex            sync.Mutex
+	typeHandlers     map[int][]AlertHandler
+	categoryHandlers []alertCategoryHandler
+	subscribers      map[chan *Alert]int
+	recent           []*Alert
+	lastId           int64
+}
+
+func NewAlertDispatcher() *AlertDispatcher {
+	return &AlertDispatcher{
+		typeHandlers: make(map[int][]AlertHandler),
+		subscribers:  make(map[chan *Alert]int),
+		recent:       make([]*Alert, 0, alertRingSize),
+	}
+}
+
+// Handle registers a handler for an alert type, ex:
+// libtorrent.Torrent_added_alertAlert_type.
+func (ad *AlertDispatcher) Handle(alertType int, handler AlertHandler) {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	ad.typeHandlers[alertType] = append(ad.typeHandlers[alertType], handler)
+}
+
+// HandleCategory registers a handler for every alert in one of the
+// categories, ex: libtorrent.AlertError_notification.
+func (ad *AlertDispatcher) HandleCategory(categoryMask int, handler AlertHandler) {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	ad.categoryHandlers = append(ad.categoryHandlers, alertCategoryHandler{categoryMask: categoryMask, handler: handler})
+}
+
+func (ad *AlertDispatcher) Subscribe(categoryMask int) chan *Alert {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	alertChan := make(chan *Alert, alertBufferSize)
+	ad.subscribers[alertChan] = categoryMask
+	return alertChan
+}
+
+func (ad *AlertDispatcher) Unsubscribe(alertChan chan *Alert) {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	delete(ad.subscribers, alertChan)
+}
+
+// Dispatch returns false when no handler was interested in the alert,
+// subscribers only watch them.
+func (ad *AlertDispatcher) Dispatch(alert *Alert) bool {
+	ad.mutex.Lock()
+	ad.lastId++
+	alert.Id = ad.lastId
+	if len(ad.recent) < alertRingSize {
+		ad.recent = append(ad.recent, alert)
+	} else {
+		ad.recent[(alert.Id-1)%alertRingSize] = alert
+	}
+
+	handlers := append([]AlertHandler{}, ad.typeHandlers[alert.xtype]...)
+	for _, categoryHandler := range ad.categoryHandlers {
+		if alert.HasCategory(categoryHandler.categoryMask) {
+			handlers = append(handlers, categoryHandler.handler)
+		}
+	}
+
+	for alertChan, categoryMask := range ad.subscribers {
+		if alert.HasCategory(categoryMask) {
+			select {
+			case alertChan <- alert:
+			default:
+			}
+		}
+	}
+	ad.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(alert)
+	}
+	return len(handlers) > 0
+}
+
+// Recent returns the buffered alerts, oldest first.
+func (ad *AlertDispatcher) Recent() []*Alert {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	if len(ad.recent) < alertRingSize {
+		return append([]*Alert{}, ad.recent...)
+	}
+
+	start := int(ad.lastId % alertRingSize)
+	return append(append([]*Alert{}, ad.recent[start:]...), ad.recent[:start]...)
+}
+
+func acceptAlert(categoryMask int, infoHashes map[string]bool, alert *Alert) bool {
+	return alert.HasCategory(categoryMask) && (len(infoHashes) == 0 || infoHashes[alert.InfoHash])
+}
+
+// debugAlerts returns the recent alerts, or streams them with ?follow=true.
+// Both accept category and info_hash filters.
+func debugAlerts(w http.ResponseWriter, r *http.Request) {
+	categoryMask, err := parseAlertCategories(r.URL.Query().Get("category"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	infoHashes := getEventFilter(r)
+	dispatcher := httpInstance.bitTorrent.alerts
+
+	if r.URL.Query().Get("follow") != "true" {
+		result := make([]*Alert, 0)
+		for _, alert := range dispatcher.Recent() {
+			if acceptAlert(categoryMask, infoHashes, alert) {
+				result = append(result, alert)
+			}
+		}
+		serveJsonStatus(w, http.StatusOK, result)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	alertChan := dispatcher.Subscribe(categoryMask)
+	defer dispatcher.Unsubscribe(alertChan)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(eventKeepAliveDelay):
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case alert := <-alertChan:
+			if !acceptAlert(categoryMask, infoHashes, alert) {
+				continue
+			}
+			data, err := json.Marshal(alert)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", alert.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// logUnhandledAlert only logs errors, the session also reports tracker,
+// peer and status alerts on every occurrence.
+func logUnhandledAlert(alert *Alert) {
+	if !alert.HasCategory(int(libtorrent.AlertError_notification)) {
+		return
+	}
+	log.Printf("[scrapmagnet] %s: %s", alert.Type, alert.Message)
+}
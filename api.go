@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/drone/routes"
+)
+
+const apiPrefix = "/api/v1"
+
+func addApiRoutes(mux *routes.RouteMux) {
+	mux.Get(apiPrefix+"/torrents", apiListTorrents)
+	mux.Post(apiPrefix+"/torrents", addTorrent)
+	mux.Get(apiPrefix+"/torrents/:hash", apiGetTorrent)
+	mux.Del(apiPrefix+"/torrents/:hash", apiDeleteTorrent)
+	mux.Post(apiPrefix+"/torrents/:hash/pause", apiPauseTorrent)
+	mux.Post(apiPrefix+"/torrents/:hash/resume", apiResumeTorrent)
+	mux.Post(apiPrefix+"/torrents/:hash/recheck", apiRecheckTorrent)
+	mux.Get(apiPrefix+"/torrents/:hash/files/:index", apiGetTorrentFile)
+	mux.Post(apiPrefix+"/torrents/:hash/files/priorities", apiSetFilePriorities)
+	mux.Get(apiPrefix+"/torrents/:hash/files/:index/subtitles", apiEmbeddedSubtitles)
+	mux.Get(apiPrefix+"/torrents/:hash/files/:index/subtitles/:track", apiEmbeddedSubtitles)
+	mux.Get(apiPrefix+"/torrents/:hash/torrent", apiGetTorrentMetadata)
+	mux.Get(apiPrefix+"/torrents/:hash/diagnostics", apiGetTorrentDiagnostics)
+	mux.Get(apiPrefix+"/errors", apiListErrors)
+	mux.Get(apiPrefix+"/webhooks", apiListWebhooks)
+	mux.Post(apiPrefix+"/webhooks", apiAddWebhook)
+	mux.Del(apiPrefix+"/webhooks/:id", apiDeleteWebhook)
+}
+
+func apiListTorrents(w http.ResponseWriter, r *http.Request) {
+	routes.ServeJson(w, httpInstance.bitTorrent.GetTorrentInfos())
+}
+
+func apiGetTorrent(w http.ResponseWriter, r *http.Request) {
+	if torrentInfo := httpInstance.bitTorrent.GetTorrentInfo(getInfoHashParam(r)); torrentInfo != nil {
+		routes.ServeJson(w, torrentInfo)
+	} else {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+	}
+}
+
+func apiDeleteTorrent(w http.ResponseWriter, r *http.Request) {
+	deleteFiles, err := strconv.ParseBool(getQueryParam(r, "delete_files", strconv.FormatBool(!settings.keepFiles)))
+	if err != nil {
+		http.Error(w, "Invalid delete_files", http.StatusBadRequest)
+		return
+	}
+
+	apiTorrentAction(w, httpInstance.bitTorrent.RemoveTorrent(getInfoHashParam(r), deleteFiles))
+}
+
+func apiPauseTorrent(w http.ResponseWriter, r *http.Request) {
+	apiTorrentAction(w, httpInstance.bitTorrent.PauseTorrent(getInfoHashParam(r)))
+}
+
+func apiResumeTorrent(w http.ResponseWriter, r *http.Request) {
+	apiTorrentAction(w, httpInstance.bitTorrent.ResumeTorrent(getInfoHashParam(r)))
+}
+
+func apiRecheckTorrent(w http.ResponseWriter, r *http.Request) {
+	apiTorrentAction(w, httpInstance.bitTorrent.RecheckTorrent(getInfoHashParam(r)))
+}
+
+func apiGetTorrentFile(w http.ResponseWriter, r *http.Request) {
+	torrentInfo := httpInstance.bitTorrent.GetTorrentInfo(getInfoHashParam(r))
+	if torrentInfo == nil {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get(":index"))
+	if err != nil {
+		http.Error(w, "Invalid file index", http.StatusBadRequest)
+		return
+	}
+
+	if torrentFileInfo := torrentInfo.GetTorrentFileInfoByIndex(index); torrentFileInfo != nil {
+		routes.ServeJson(w, torrentFileInfo)
+	} else {
+		fileNotFound(w, torrentInfo)
+	}
+}
+
+func apiGetTorrentMetadata(w http.ResponseWriter, r *http.Request) {
+	infoHash := getInfoHashParam(r)
+	if settings.metadataCacheDir == "" {
+		http.Error(w, "Metadata cache disabled", http.StatusNotFound)
+		return
+	} else if !isInfoHash(infoHash) {
+		http.Error(w, "Invalid infohash", http.StatusBadRequest)
+		return
+	}
+
+	torrentData, err := readCachedMetadata(infoHash)
+	if err != nil {
+		http.Error(w, "Metadata not cached", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", infoHash+".torrent"))
+	w.Write(torrentData)
+}
+
+func apiListWebhooks(w http.ResponseWriter, r *http.Request) {
+	routes.ServeJson(w, webhooks.List())
+}
+
+func apiAddWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := &Webhook{}
+	if err := json.NewDecoder(r.Body).Decode(webhook); err != nil {
+		http.Error(w, "Invalid webhook", http.StatusBadRequest)
+		return
+	}
+
+	// Ids are always generated
+	webhook.Id = ""
+	webhook, err := webhooks.Add(webhook, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := *webhook
+	result.Secret = ""
+	serveJsonStatus(w, http.StatusCreated, &result)
+}
+
+func apiDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if webhooks.Remove(r.URL.Query().Get(":id")) {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+	}
+}
+
+func apiTorrentAction(w http.ResponseWriter, found bool) {
+	if found {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+	}
+}
+
+func getInfoHashParam(r *http.Request) string {
+	return strings.ToUpper(r.URL.Query().Get(":hash"))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"strings"
+)
+
+func parseTokens(tokens string) (result []string) {
+	for _, token := range strings.Split(tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			result = append(result, token)
+		}
+	}
+	return result
+}
+
+func isAuthEnabled() bool {
+	return len(parseTokens(settings.adminTokens)) > 0 || len(parseTokens(settings.viewerTokens)) > 0
+}
+
+// getRequestToken accepts a bearer token, or a token query parameter for
+// players that can't set headers.
+func getRequestToken(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+func containsToken(tokens []string, token string) bool {
+	found := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// addingPaths add the torrent described by the query, unless info_hash is
+// given.
+var addingPaths = map[string]bool{
+	"/video":     true,
+	"/ready":     true,
+	"/subtitles": true,
+}
+
+// adminOnlyPaths are read only but expose secrets, ex: webhook URLs or
+// private tracker passkeys.
+var adminOnlyPaths = []string{
+	apiPrefix + "/webhooks",
+	apiPrefix + "/errors",
+	apiPrefix + "/torrents/*/torrent",
+	apiPrefix + "/torrents/*/diagnostics",
+	"/debug/alerts",
+}
+
+func isAdminOnlyPath(urlPath string) bool {
+	for _, pattern := range adminOnlyPaths {
+		if matched, _ := path.Match(pattern, urlPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// addsTorrent tells whether the request would add a torrent, or have the
+// server read a torrent_url or torrent_path. Magnet links of torrents already
+// added are only streamed.
+func addsTorrent(r *http.Request) bool {
+	query := r.URL.Query()
+	if !addingPaths[r.URL.Path] || query.Get("info_hash") != "" {
+		return false
+	}
+	if magnetLink := query.Get("magnet_link"); magnetLink != "" {
+		magnet, err := ParseMagnet(magnetLink)
+		return err != nil || httpInstance == nil || !httpInstance.bitTorrent.HasTorrent(magnet.InfoHash)
+	}
+	return query.Get("torrent_url") != "" || query.Get("torrent_path") != ""
+}
+
+// requiresAdmin tells whether the request requires an admin token.
+func requiresAdmin(r *http.Request) bool {
+	return (r.Method != "GET" && r.Method != "HEAD") || isAdminOnlyPath(r.URL.Path) || addsTorrent(r)
+}
+
+// authFilter runs before every route. Once it writes a response the route
+// handler is skipped.
+func authFilter(w http.ResponseWriter, r *http.Request) {
+	if !isAuthEnabled() {
+		return
+	}
+
+	token := getRequestToken(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scrapmagnet"`)
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if containsToken(parseTokens(settings.adminTokens), token) {
+		return
+	}
+
+	if containsToken(parseTokens(settings.viewerTokens), token) {
+		if requiresAdmin(r) {
+			http.Error(w, "Admin token required", http.StatusForbidden)
+		}
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="scrapmagnet", error="invalid_token"`)
+	http.Error(w, "Invalid token", http.StatusUnauthorized)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const (
+	testAdminToken  = "admin-secret"
+	testViewerToken = "viewer-secret"
+)
+
+// setTestAuth returns the function restoring the previous settings.
+func setTestAuth(adminTokens string, viewerTokens string) func() {
+	previousAdminTokens, previousViewerTokens, previousHttp := settings.adminTokens, settings.viewerTokens, httpInstance
+	settings.adminTokens, settings.viewerTokens = adminTokens, viewerTokens
+
+	// A torrent already added, only streamed by magnet links
+	httpInstance = &Http{bitTorrent: NewBitTorrent()}
+	httpInstance.bitTorrent.registry.Add(testInfoHash, nil, 0.005, nil, nil, "")
+	httpInstance.bitTorrent.registry.OnAdded(testInfoHash, true)
+
+	return func() {
+		settings.adminTokens, settings.viewerTokens, httpInstance = previousAdminTokens, previousViewerTokens, previousHttp
+	}
+}
+
+func getTestMagnetLink(infoHash string) string {
+	return url.QueryEscape("magnet:?xt=urn:btih:" + infoHash)
+}
+
+func TestRequiresAdmin(t *testing.T) {
+	defer setTestAuth(testAdminToken, testViewerToken)()
+
+	newInfoHash := "89ABCDEF0123456789ABCDEF0123456789ABCDEF"
+	tests := []struct {
+		method   string
+		target   string
+		expected bool
+	}{
+		{"GET", "/", false},
+		{"HEAD", "/metrics", false},
+		{"GET", "/api/v1/torrents", false},
+		{"GET", "/api/v1/torrents/" + testInfoHash, false},
+		{"GET", "/api/v1/torrents/" + testInfoHash + "/files/0", false},
+		{"POST", "/shutdown", true},
+		{"POST", "/torrents", true},
+		{"POST", "/api/v1/torrents/" + testInfoHash + "/pause", true},
+		{"DELETE", "/api/v1/torrents/" + testInfoHash, true},
+		{"GET", "/api/v1/webhooks", true},
+		{"GET", "/api/v1/errors", true},
+		{"GET", "/api/v1/torrents/" + testInfoHash + "/torrent", true},
+		{"GET", "/api/v1/torrents/" + testInfoHash + "/diagnostics", true},
+		{"GET", "/debug/alerts?follow=true", true},
+
+		{"GET", "/video?info_hash=" + testInfoHash, false},
+		{"GET", "/video?magnet_link=" + getTestMagnetLink(testInfoHash), false},
+		{"GET", "/ready?magnet_link=" + getTestMagnetLink(testInfoHash), false},
+		{"GET", "/subtitles?magnet_link=" + getTestMagnetLink(testInfoHash), false},
+		{"GET", "/video?magnet_link=" + getTestMagnetLink(newInfoHash), true},
+		{"GET", "/ready?magnet_link=" + getTestMagnetLink(newInfoHash), true},
+		{"GET", "/subtitles?magnet_link=" + getTestMagnetLink(newInfoHash), true},
+		{"GET", "/video?magnet_link=invalid", true},
+		{"GET", "/video?torrent_url=http%3A%2F%2Fexample.com%2Fa.torrent", true},
+		{"GET", "/ready?torrent_path=a.torrent", true},
+		{"GET", "/video?info_hash=" + testInfoHash + "&torrent_url=http%3A%2F%2Fexample.com%2Fa.torrent", false},
+		{"GET", "/video", false},
+	}
+
+	for _, test := range tests {
+		if result := requiresAdmin(httptest.NewRequest(test.method, test.target, nil)); result != test.expected {
+			t.Errorf("requiresAdmin(%v %v) = %v, expected %v", test.method, test.target, result, test.expected)
+		}
+	}
+}
+
+func TestAuthFilter(t *testing.T) {
+	defer setTestAuth(testAdminToken+", other-admin", testViewerToken)()
+
+	tests := []struct {
+		method        string
+		target        string
+		authorization string
+		expected      int
+	}{
+		{"GET", "/api/v1/torrents", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/torrents", "Bearer wrong", http.StatusUnauthorized},
+		{"GET", "/api/v1/torrents?token=wrong", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/torrents", "Basic " + testAdminToken, http.StatusUnauthorized},
+		{"GET", "/api/v1/torrents", "Bearer " + testViewerToken, http.StatusOK},
+		{"GET", "/api/v1/torrents?token=" + testViewerToken, "", http.StatusOK},
+		{"GET", "/api/v1/torrents", "Bearer other-admin", http.StatusOK},
+
+		// The header wins over the query parameter
+		{"POST", "/shutdown?token=" + testAdminToken, "Bearer " + testViewerToken, http.StatusForbidden},
+		{"POST", "/shutdown?token=" + testViewerToken, "Bearer " + testAdminToken, http.StatusOK},
+
+		{"POST", "/shutdown", "Bearer " + testViewerToken, http.StatusForbidden},
+		{"POST", "/shutdown", "Bearer " + testAdminToken, http.StatusOK},
+		{"GET", "/api/v1/webhooks", "Bearer " + testViewerToken, http.StatusForbidden},
+		{"GET", "/api/v1/webhooks", "Bearer " + testAdminToken, http.StatusOK},
+		{"GET", "/api/v1/torrents/" + testInfoHash + "/torrent", "Bearer " + testViewerToken, http.StatusForbidden},
+		{"GET", "/video?magnet_link=" + getTestMagnetLink(testInfoHash), "Bearer " + testViewerToken, http.StatusOK},
+		{"GET", "/video?magnet_link=" + getTestMagnetLink("89ABCDEF0123456789ABCDEF0123456789ABCDEF"), "Bearer " + testViewerToken, http.StatusForbidden},
+		{"GET", "/video?magnet_link=" + getTestMagnetLink("89ABCDEF0123456789ABCDEF0123456789ABCDEF"), "Bearer " + testAdminToken, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		authFilter(w, r)
+		if w.Code != test.expected {
+			t.Errorf("authFilter(%v %v, %q) = %v, expected %v", test.method, test.target, test.authorization, w.Code, test.expected)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("authFilter(%v %v) didn't ask for a token", test.method, test.target)
+		}
+	}
+}
+
+func TestAuthFilterDisabled(t *testing.T) {
+	defer setTestAuth("", " , ")()
+
+	w := httptest.NewRecorder()
+	authFilter(w, httptest.NewRequest("POST", "/shutdown", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("authFilter() without tokens = %v, expected %v", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// maxBencodeDepth bounds the recursion on nested lists and dictionaries.
+const maxBencodeDepth = 64
+
+var errBencodeMalformed = errors.New("Malformed bencoded data")
+
+// bdecoder decodes bencoded data into int64, string, []interface{} and
+// map[string]interface{} values.
+type bdecoder struct {
+	data []byte
+	pos  int
+}
+
+// decode is given the nesting depth of the value.
+func (d *bdecoder) decode(depth int) (interface{}, error) {
+	if d.pos >= len(d.data) || depth > maxBencodeDepth {
+		return nil, errBencodeMalformed
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end == -1 {
+			return nil, errBencodeMalformed
+		}
+		value, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, errBencodeMalformed
+		}
+		d.pos += end + 1
+		return value, nil
+	case c == 'l':
+		d.pos++
+		result := make([]interface{}, 0)
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+		if d.pos >= len(d.data) {
+			return nil, errBencodeMalformed
+		}
+		d.pos++
+		return result, nil
+	case c == 'd':
+		d.pos++
+		result := make(map[string]interface{})
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			key, err := d.decodeString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+		}
+		if d.pos >= len(d.data) {
+			return nil, errBencodeMalformed
+		}
+		d.pos++
+		return result, nil
+	case c >= '0' && c <= '9':
+		return d.decodeString()
+	default:
+		return nil, errBencodeMalformed
+	}
+}
+
+func (d *bdecoder) decodeString() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon == -1 {
+		return "", errBencodeMalformed
+	}
+	length, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	if err != nil || length < 0 || length > len(d.data) || d.pos+colon+1+length > len(d.data) {
+		return "", errBencodeMalformed
+	}
+	start := d.pos + colon + 1
+	d.pos = start + length
+	return string(d.data[start:d.pos]), nil
+}
+
+// getTorrentFileInfoHash computes the infohash of a .torrent file from the
+// raw bytes of its info dictionary, formatted like getTorrentInfoHash.
+func getTorrentFileInfoHash(torrentData []byte) (string, error) {
+	info, err := getTorrentFileInfoDict(torrentData)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%X", sha1.Sum(info)), nil
+}
+
+func getTorrentFileInfoDict(torrentData []byte) ([]byte, error) {
+	d := &bdecoder{data: torrentData}
+	if len(d.data) == 0 || d.data[0] != 'd' {
+		return nil, errBencodeMalformed
+	}
+
+	d.pos++
+	for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+		key, err := d.decodeString()
+		if err != nil {
+			return nil, err
+		}
+		start := d.pos
+		value, err := d.decode(2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			if _, ok := value.(map[string]interface{}); !ok {
+				return nil, errors.New("Invalid info dictionary")
+			}
+			return d.data[start:d.pos], nil
+		}
+	}
+	return nil, errors.New("Missing info dictionary")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBdecoderDecode(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected interface{}
+	}{
+		{"i42e", int64(42)},
+		{"i-3e", int64(-3)},
+		{"4:spam", "spam"},
+		{"0:", ""},
+		{"le", []interface{}{}},
+		{"l4:spami1ee", []interface{}{"spam", int64(1)}},
+		{"d3:cow3:moo4:spaml1:a1:bee", map[string]interface{}{"cow": "moo", "spam": []interface{}{"a", "b"}}},
+		{"lld1:ai1eeee", []interface{}{[]interface{}{map[string]interface{}{"a": int64(1)}}}},
+	}
+
+	for _, test := range tests {
+		d := &bdecoder{data: []byte(test.data)}
+		value, err := d.decode(1)
+		if err != nil {
+			t.Errorf("decode(%q) failed: %v", test.data, err)
+		} else if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("decode(%q) = %#v, expected %#v", test.data, value, test.expected)
+		} else if d.pos != len(test.data) {
+			t.Errorf("decode(%q) stopped at %v", test.data, d.pos)
+		}
+	}
+}
+
+func TestBdecoderDecodeMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"i42",
+		"iabce",
+		"4:spa",
+		"l4:spam",
+		"d3:cow",
+		"d3:cow3:moo",
+		"di1ei2ee",
+		"x",
+		"-1:",
+		"9223372036854775807:a",
+		strings.Repeat("l", maxBencodeDepth+1) + strings.Repeat("e", maxBencodeDepth+1),
+		strings.Repeat("d1:a", maxBencodeDepth+1) + "i0e" + strings.Repeat("e", maxBencodeDepth+1),
+	}
+
+	for _, test := range tests {
+		d := &bdecoder{data: []byte(test)}
+		if value, err := d.decode(1); err != errBencodeMalformed {
+			t.Errorf("decode(%.20q) = %#v, %v, expected %v", test, value, err, errBencodeMalformed)
+		}
+	}
+}
+
+func TestBdecoderDecodeMaxDepth(t *testing.T) {
+	data := strings.Repeat("l", maxBencodeDepth) + strings.Repeat("e", maxBencodeDepth)
+	d := &bdecoder{data: []byte(data)}
+	if _, err := d.decode(1); err != nil {
+		t.Errorf("decode of %v nested lists failed: %v", maxBencodeDepth, err)
+	}
+
+	// Would overflow the stack without a depth limit
+	data = strings.Repeat("l", maxTorrentFileSize)
+	d = &bdecoder{data: []byte(data)}
+	if _, err := d.decode(1); err != errBencodeMalformed {
+		t.Errorf("decode of deeply nested lists = %v, expected %v", err, errBencodeMalformed)
+	}
+}
+
+func TestGetTorrentFileInfoHash(t *testing.T) {
+	info := "d6:lengthi12e4:name8:file.txt12:piece lengthi16384ee"
+	expected := fmt.Sprintf("%X", sha1.Sum([]byte(info)))
+
+	tests := []string{
+		"d4:info" + info + "e",
+		"d8:announce13:http://a/anno4:info" + info + "e",
+		"d7:comment" + "l1:a1:be" + "4:info" + info + "7:zzzzzzzi1ee",
+	}
+	for _, test := range tests {
+		infoHash, err := getTorrentFileInfoHash([]byte(test))
+		if err != nil {
+			t.Errorf("getTorrentFileInfoHash(%q) failed: %v", test, err)
+		} else if infoHash != expected {
+			t.Errorf("getTorrentFileInfoHash(%q) = %v, expected %v", test, infoHash, expected)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"le",
+		"de",
+		"d4:infoi1ee",
+		"d4:info" + info[:len(info)-1],
+		"d4:info" + strings.Repeat("d1:a", maxBencodeDepth) + "i0e" + strings.Repeat("e", maxBencodeDepth+1),
+	}
+	for _, test := range invalid {
+		if infoHash, err := getTorrentFileInfoHash([]byte(test)); err == nil {
+			t.Errorf("getTorrentFileInfoHash(%.30q) = %v, expected an error", test, infoHash)
+		}
+	}
+}
@@ -1,23 +1,33 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
 	"path"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sharkone/libtorrent-go"
 )
 
 type TorrentFileInfo struct {
+	Index          int      `json:"index"`
 	Path           string   `json:"path"`
 	Size           int64    `json:"size"`
 	CompletePieces int      `json:"complete_pieces"`
 	TotalPieces    int      `json:"total_pieces"`
 	PieceMap       []string `json:"piece_map"`
+	Priority       int      `json:"priority"`
+
+	Subtitles []*SubtitleInfo `json:"subtitles,omitempty"`
 
 	handle      libtorrent.Torrent_handle
 	offset      int64
@@ -25,12 +35,15 @@ type TorrentFileInfo struct {
 	startPiece  int
 	endPiece    int
 
+	ctx       context.Context
 	file      *os.File
 	bytesRead int
+	stream    *StreamInfo
 }
 
-func NewTorrentFileInfo(path string, size int64, offset int64, pieceLength int, handle libtorrent.Torrent_handle) *TorrentFileInfo {
+func NewTorrentFileInfo(index int, path string, size int64, offset int64, pieceLength int, handle libtorrent.Torrent_handle) *TorrentFileInfo {
 	result := &TorrentFileInfo{}
+	result.Index = index
 	result.Path = path
 	result.Size = size
 	result.offset = offset
@@ -41,6 +54,7 @@ func NewTorrentFileInfo(path string, size int64, offset int64, pieceLength int,
 	result.CompletePieces = result.GetCompletePieces()
 	result.TotalPieces = 1 + result.endPiece - result.startPiece
 	result.PieceMap = result.GetPieceMap()
+	result.Priority = fileNormalPriority
 	return result
 }
 
@@ -81,6 +95,8 @@ func (tfi *TorrentFileInfo) GetPieceMap() []string {
 }
 
 func (tfi *TorrentFileInfo) SetInitialPriority() {
+	bitTorrent.wantTorrentFile(tfi)
+
 	start := tfi.startPiece
 	end := int(math.Min(float64(start+tfi.getLookAhead(true)), float64(tfi.endPiece)))
 	for i := start; i <= end; i++ {
@@ -106,22 +122,37 @@ func (tfi *TorrentFileInfo) IsVideoReady() bool {
 	return true
 }
 
-func (tfi *TorrentFileInfo) Open(downloadDir string) bool {
+// Open waits for the file to be created on disk. Reads and seeks on the file
+// are cancelled along with ctx.
+func (tfi *TorrentFileInfo) Open(ctx context.Context, downloadDir string) error {
 	if tfi.file == nil {
+		tfi.ctx = ctx
 		fullpath := path.Join(downloadDir, tfi.Path)
+		if err := checkStoragePath(fullpath); err != nil {
+			return err
+		}
 
-		for {
-			if _, err := os.Stat(fullpath); err == nil {
-				break
-			}
-			time.Sleep(100 * time.Millisecond)
+		if err := tfi.waitFor(func() bool {
+			_, err := os.Stat(fullpath)
+			return err == nil
+		}); err != nil {
+			return err
 		}
 
-		tfi.file, _ = os.Open(fullpath)
+		// The file may be reached through a symlink created meanwhile
+		if err := checkStoragePath(fullpath); err != nil {
+			return err
+		}
+
+		file, err := os.Open(fullpath)
+		if err != nil {
+			return err
+		}
+		tfi.file = file
 		tfi.bytesRead = 0
 	}
 
-	return tfi.file != nil
+	return nil
 }
 
 func (tfi *TorrentFileInfo) Close() {
@@ -139,7 +170,15 @@ func (tfi *TorrentFileInfo) Read(data []byte) (int, error) {
 
 		currentPosition, _ := tfi.file.Seek(0, os.SEEK_CUR)
 		pieceIndex := tfi.GetPieceIndexFromOffset(currentPosition + readSize)
-		tfi.waitForPiece(pieceIndex, false)
+		waitStart := time.Now()
+		rebuffering := !tfi.handle.Have_piece(pieceIndex)
+		if err := tfi.waitForPiece(pieceIndex, false); err != nil {
+			return totalRead, err
+		}
+		if rebuffering && tfi.stream != nil {
+			tfi.stream.onRebuffer(time.Since(waitStart))
+			tfi.publishStreamEvent("rebuffer")
+		}
 
 		tmpData := make([]byte, readSize)
 		read, err := tfi.file.Read(tmpData)
@@ -155,16 +194,70 @@ func (tfi *TorrentFileInfo) Read(data []byte) (int, error) {
 	}
 
 	tfi.bytesRead += totalRead
+	metrics.AddServedBytes(tfi.GetInfoHashStr(), totalRead)
 
-	if tfi.bytesRead > (10*1024*1024) && !bitTorrent.connectionInfos[tfi.GetInfoHashStr()].Served {
-		log.Printf("[scrapmagnet] Serving %v", tfi.handle.Status().GetName())
-		trackingEvent("Serving", map[string]interface{}{"Magnet InfoHash": tfi.GetInfoHashStr(), "Magnet Name": tfi.handle.Status().GetName()}, bitTorrent.mixpanelData[tfi.GetInfoHashStr()])
-		bitTorrent.connectionInfos[tfi.GetInfoHashStr()].Served = true
+	if tfi.stream != nil {
+		currentPosition, _ := tfi.file.Seek(0, os.SEEK_CUR)
+		if tfi.stream.onRead(currentPosition) {
+			tfi.publishStreamEvent("first_byte")
+		}
+		tfi.stream.updateAhead(tfi)
+	}
+
+	if tfi.bytesRead > (10 * 1024 * 1024) {
+		// The torrent may have been removed while streaming
+		if entry, ok := bitTorrent.registry.Get(tfi.GetInfoHashStr()); ok && entry.connectionInfo.setServed() {
+			log.Printf("[scrapmagnet] Serving %v", tfi.handle.Status().GetName())
+			trackingEvent("Serving", map[string]interface{}{"Magnet InfoHash": tfi.GetInfoHashStr(), "Magnet Name": tfi.handle.Status().GetName()}, entry.mixpanelData)
+		}
 	}
 
 	return totalRead, nil
 }
 
+// StartStream attaches QoS measurements to the file until StopStream.
+func (tfi *TorrentFileInfo) StartStream(startedAt time.Time) {
+	entry, ok := bitTorrent.registry.Get(tfi.GetInfoHashStr())
+	if !ok {
+		return
+	}
+
+	tfi.stream = NewStreamInfo(tfi.Path, entry.connectionInfo.GetTimeToMetadata(), startedAt)
+	entry.connectionInfo.AddStream(tfi.stream)
+	tfi.publishStreamEvent("stream_started")
+}
+
+func (tfi *TorrentFileInfo) StopStream() {
+	if tfi.stream != nil {
+		tfi.stream.onStop()
+		tfi.publishStreamEvent("stream_stopped")
+	}
+}
+
+func (tfi *TorrentFileInfo) publishStreamEvent(eventType string) {
+	if settings.qosEvents {
+		bitTorrent.events.Publish(eventType, tfi.handle, tfi.stream)
+	} else {
+		bitTorrent.events.Notify(eventType, tfi.handle, tfi.stream)
+	}
+}
+
+// GetAheadBytes returns how many bytes following position are downloaded.
+func (tfi *TorrentFileInfo) GetAheadBytes(position int64) int64 {
+	pieceIndex := tfi.GetPieceIndexFromOffset(position)
+	for pieceIndex <= tfi.endPiece && tfi.handle.Have_piece(pieceIndex) {
+		pieceIndex++
+	}
+
+	aheadBytes := int64(pieceIndex)*int64(tfi.pieceLength) - tfi.offset - position
+	if aheadBytes < 0 {
+		return 0
+	} else if aheadBytes > tfi.Size-position {
+		return tfi.Size - position
+	}
+	return aheadBytes
+}
+
 func (tfi *TorrentFileInfo) Seek(offset int64, whence int) (int64, error) {
 	newPosition := int64(0)
 
@@ -179,7 +272,9 @@ func (tfi *TorrentFileInfo) Seek(offset int64, whence int) (int64, error) {
 	}
 
 	pieceIndex := tfi.GetPieceIndexFromOffset(newPosition)
-	tfi.waitForPiece(pieceIndex, true)
+	if err := tfi.waitForPiece(pieceIndex, true); err != nil {
+		return 0, err
+	}
 
 	ret, err := tfi.file.Seek(offset, whence)
 	if err != nil || ret != newPosition {
@@ -189,7 +284,7 @@ func (tfi *TorrentFileInfo) Seek(offset int64, whence int) (int64, error) {
 	return ret, err
 }
 
-func (tfi *TorrentFileInfo) waitForPiece(pieceIndex int, timeCritical bool) bool {
+func (tfi *TorrentFileInfo) waitForPiece(pieceIndex int, timeCritical bool) error {
 	if !tfi.handle.Have_piece(pieceIndex) {
 		if timeCritical {
 			tfi.handle.Clear_piece_deadlines()
@@ -207,20 +302,130 @@ func (tfi *TorrentFileInfo) waitForPiece(pieceIndex int, timeCritical bool) bool
 
 		tfi.SetInitialPriority()
 
-		for {
-			time.Sleep(100 * time.Millisecond)
-			if tfi.handle.Have_piece(pieceIndex) {
-				break
-			}
+		// Shown by the diagnostics endpoint
+		if entry, ok := bitTorrent.registry.Get(tfi.GetInfoHashStr()); ok {
+			endWait := entry.activity.beginPieceWait(pieceIndex)
+			defer endWait()
 		}
+
+		defer func(start time.Time) {
+			metrics.AddPieceWait(time.Since(start))
+		}(time.Now())
+
+		return tfi.waitFor(func() bool {
+			return tfi.handle.Have_piece(pieceIndex)
+		})
 	}
 
-	return false
+	return nil
+}
+
+// TorrentFileReader reads a file out of the streaming order, ex: the
+// subtitle track of a Matroska file. Only the pieces read are wanted, without
+// deadlines, so streams of the torrent keep theirs.
+type TorrentFileReader struct {
+	tfi      *TorrentFileInfo
+	position int64
+}
+
+// NewReader must be called once the file is open.
+func (tfi *TorrentFileInfo) NewReader() *TorrentFileReader {
+	return &TorrentFileReader{tfi: tfi}
+}
+
+// Read stops at the end of a piece, the next one may not be needed.
+func (tfr *TorrentFileReader) Read(data []byte) (int, error) {
+	if tfr.position >= tfr.tfi.Size {
+		return 0, io.EOF
+	}
+
+	pieceIndex := tfr.tfi.GetPieceIndexFromOffset(tfr.position)
+	pieceEnd := int64(pieceIndex+1)*int64(tfr.tfi.pieceLength) - tfr.tfi.offset
+	if int64(len(data)) > pieceEnd-tfr.position {
+		data = data[:pieceEnd-tfr.position]
+	}
+	if err := tfr.tfi.waitForBackgroundPiece(pieceIndex); err != nil {
+		return 0, err
+	}
+
+	read, err := tfr.tfi.file.ReadAt(data, tfr.position)
+	tfr.position += int64(read)
+	if err == io.EOF && read > 0 {
+		err = nil
+	}
+	return read, err
+}
+
+// Seek doesn't wait for anything, pieces are waited for when read.
+func (tfr *TorrentFileReader) Seek(offset int64, whence int) (int64, error) {
+	newPosition := offset
+	switch whence {
+	case os.SEEK_CUR:
+		newPosition += tfr.position
+	case os.SEEK_END:
+		newPosition += tfr.tfi.Size
+	}
+
+	if newPosition < 0 {
+		return tfr.position, fmt.Errorf("Invalid position %v", newPosition)
+	}
+	tfr.position = newPosition
+	return newPosition, nil
+}
+
+// waitForBackgroundPiece raises the priority of the piece without going
+// above the one of streamed pieces.
+func (tfi *TorrentFileInfo) waitForBackgroundPiece(pieceIndex int) error {
+	if tfi.handle.Have_piece(pieceIndex) {
+		return nil
+	}
+
+	if priority, ok := tfi.handle.Piece_priority(pieceIndex).(int); !ok || priority < backgroundPiecePriority {
+		tfi.handle.Piece_priority(pieceIndex, backgroundPiecePriority)
+	}
+
+	// Shown by the diagnostics endpoint
+	if entry, ok := bitTorrent.registry.Get(tfi.GetInfoHashStr()); ok {
+		endWait := entry.activity.beginPieceWait(pieceIndex)
+		defer endWait()
+	}
+
+	return tfi.waitFor(func() bool {
+		return tfi.handle.Have_piece(pieceIndex)
+	})
+}
+
+// waitFor polls until ready returns true, the stream context is cancelled or
+// the configured piece wait timeout expires.
+func (tfi *TorrentFileInfo) waitFor(ready func() bool) error {
+	ctx := tfi.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if settings.pieceWaitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(settings.pieceWaitTimeout)*time.Second)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !ready() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
 
 func (tfi *TorrentFileInfo) getLookAhead(initial bool) int {
 	if initial {
-		return int(float32(tfi.TotalPieces) * bitTorrent.lookAhead[tfi.GetInfoHashStr()])
+		if entry, ok := bitTorrent.registry.Get(tfi.GetInfoHashStr()); ok {
+			return int(float32(tfi.TotalPieces) * entry.lookAhead)
+		}
 	}
 	return int(float32(tfi.TotalPieces) * 0.005)
 }
@@ -243,7 +448,12 @@ type TorrentInfo struct {
 	TotalPeers   int                `json:"total_peers"`
 	Files        []*TorrentFileInfo `json:"files"`
 
+	Lifecycle      string                 `json:"lifecycle"`
+	SelectOnly     []int                  `json:"select_only,omitempty"`
+	Errors         []TorrentError         `json:"errors"`
 	ConnectionInfo *TorrentConnectionInfo `json:"connection_info"`
+	TimeToMetadata float64                `json:"time_to_metadata"`
+	Streams        []*StreamInfo          `json:"streams"`
 }
 
 func NewTorrentInfo(handle libtorrent.Torrent_handle) (result *TorrentInfo) {
@@ -255,28 +465,7 @@ func NewTorrentInfo(handle libtorrent.Torrent_handle) (result *TorrentInfo) {
 	result.Name = torrentStatus.GetName()
 	result.DownloadDir = torrentStatus.GetSave_path()
 	result.State = int(torrentStatus.GetState())
-	result.StateStr = func(state libtorrent.LibtorrentTorrent_statusState_t) string {
-		switch state {
-		case libtorrent.Torrent_statusQueued_for_checking:
-			return "Queued for checking"
-		case libtorrent.Torrent_statusChecking_files:
-			return "Checking files"
-		case libtorrent.Torrent_statusDownloading_metadata:
-			return "Downloading metadata"
-		case libtorrent.Torrent_statusDownloading:
-			return "Downloading"
-		case libtorrent.Torrent_statusFinished:
-			return "Finished"
-		case libtorrent.Torrent_statusSeeding:
-			return "Seeding"
-		case libtorrent.Torrent_statusAllocating:
-			return "Allocating"
-		case libtorrent.Torrent_statusChecking_resume_data:
-			return "Checking resume data"
-		default:
-			return "Unknown"
-		}
-	}(torrentStatus.GetState())
+	result.StateStr = getTorrentStateStr(torrentStatus.GetState())
 	result.Paused = torrentStatus.GetPaused()
 	result.Progress = torrentStatus.GetProgress()
 	result.DownloadRate = torrentStatus.GetDownload_rate() / 1024
@@ -290,18 +479,69 @@ func NewTorrentInfo(handle libtorrent.Torrent_handle) (result *TorrentInfo) {
 	if torrentInfo.Swigcptr() != 0 {
 		result.Files = func(torrentInfo libtorrent.Torrent_info) (result []*TorrentFileInfo) {
 			for i := 0; i < torrentInfo.Files().Num_files(); i++ {
-				result = append(result, NewTorrentFileInfo(torrentInfo.Files().File_path(i), torrentInfo.Files().File_size(i), torrentInfo.Files().File_offset(i), torrentInfo.Piece_length(), handle))
+				result = append(result, NewTorrentFileInfo(i, torrentInfo.Files().File_path(i), torrentInfo.Files().File_size(i), torrentInfo.Files().File_offset(i), torrentInfo.Piece_length(), handle))
 			}
 			return result
 		}(torrentInfo)
+		attachSubtitles(result.Files)
 		result.Size = torrentInfo.Files().Total_size()
 		result.Pieces = torrentInfo.Num_pieces()
 	}
 
-	result.ConnectionInfo = bitTorrent.connectionInfos[result.InfoHash]
+	result.Errors = make([]TorrentError, 0)
+	if entry, ok := bitTorrent.registry.Lookup(result.InfoHash); ok {
+		// Viewers can list torrents, the full URLs are on /api/v1/errors
+		result.Errors = entry.errors.Get()
+		for i := range result.Errors {
+			if result.Errors[i].URL != "" {
+				result.Errors[i].URL = getURLOrigin(result.Errors[i].URL)
+			}
+		}
+		for _, torrentFileInfo := range result.Files {
+			torrentFileInfo.Priority = entry.filePriorities.get(torrentFileInfo.Index)
+		}
+		if entry.magnet != nil {
+			result.SelectOnly = entry.magnet.SelectOnly
+		}
+	}
+	if state, ok := bitTorrent.registry.GetState(result.InfoHash); ok {
+		result.Lifecycle = state.String()
+	}
+	if entry, ok := bitTorrent.registry.Get(result.InfoHash); ok {
+		result.ConnectionInfo = entry.connectionInfo
+	}
+	result.TimeToMetadata = -1
+	result.Streams = make([]*StreamInfo, 0)
+	if result.ConnectionInfo != nil {
+		result.TimeToMetadata = durationSeconds(result.ConnectionInfo.GetTimeToMetadata())
+		result.Streams = result.ConnectionInfo.GetStreams()
+	}
 	return result
 }
 
+func getTorrentStateStr(state libtorrent.LibtorrentTorrent_statusState_t) string {
+	switch state {
+	case libtorrent.Torrent_statusQueued_for_checking:
+		return "Queued for checking"
+	case libtorrent.Torrent_statusChecking_files:
+		return "Checking files"
+	case libtorrent.Torrent_statusDownloading_metadata:
+		return "Downloading metadata"
+	case libtorrent.Torrent_statusDownloading:
+		return "Downloading"
+	case libtorrent.Torrent_statusFinished:
+		return "Finished"
+	case libtorrent.Torrent_statusSeeding:
+		return "Seeding"
+	case libtorrent.Torrent_statusAllocating:
+		return "Allocating"
+	case libtorrent.Torrent_statusChecking_resume_data:
+		return "Checking resume data"
+	default:
+		return "Unknown"
+	}
+}
+
 func (ti *TorrentInfo) GetTorrentFileInfo(filePath string) *TorrentFileInfo {
 	for _, torrentFileInfo := range ti.Files {
 		if torrentFileInfo.Path == filePath {
@@ -311,6 +551,63 @@ func (ti *TorrentInfo) GetTorrentFileInfo(filePath string) *TorrentFileInfo {
 	return nil
 }
 
+func (ti *TorrentInfo) GetTorrentFileInfoByIndex(index int) *TorrentFileInfo {
+	if index >= 0 && index < len(ti.Files) {
+		return ti.Files[index]
+	}
+	return nil
+}
+
+func (ti *TorrentInfo) GetTorrentFileInfoByMatch(pattern string) (*TorrentFileInfo, error) {
+	torrentFileInfos, err := ti.GetTorrentFileInfosByMatch(pattern)
+	if err != nil || len(torrentFileInfos) == 0 {
+		return nil, err
+	}
+	return torrentFileInfos[0], nil
+}
+
+// Patterns enclosed in slashes (ex: /S01E0[1-3]/) are regular expressions,
+// anything else is a glob matched against both the full path and the file name.
+func (ti *TorrentInfo) GetTorrentFileInfosByMatch(pattern string) ([]*TorrentFileInfo, error) {
+	result := make([]*TorrentFileInfo, 0)
+
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		regExp, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, torrentFileInfo := range ti.Files {
+			if regExp.MatchString(torrentFileInfo.Path) {
+				result = append(result, torrentFileInfo)
+			}
+		}
+		return result, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	for _, torrentFileInfo := range ti.Files {
+		if matched, _ := path.Match(pattern, torrentFileInfo.Path); matched {
+			result = append(result, torrentFileInfo)
+		} else if matched, _ := path.Match(pattern, path.Base(torrentFileInfo.Path)); matched {
+			result = append(result, torrentFileInfo)
+		}
+	}
+	return result, nil
+}
+
+// GetFirstSelectedTorrentFileInfo returns the first file of the magnet link
+// so= parameter.
+func (ti *TorrentInfo) GetFirstSelectedTorrentFileInfo() *TorrentFileInfo {
+	for _, index := range ti.SelectOnly {
+		if torrentFileInfo := ti.GetTorrentFileInfoByIndex(index); torrentFileInfo != nil {
+			return torrentFileInfo
+		}
+	}
+	return nil
+}
+
 func (ti *TorrentInfo) GetBiggestTorrentFileInfo() (result *TorrentFileInfo) {
 	for _, torrentFileInfo := range ti.Files {
 		if result == nil || torrentFileInfo.Size > result.Size {
@@ -320,51 +617,159 @@ func (ti *TorrentInfo) GetBiggestTorrentFileInfo() (result *TorrentFileInfo) {
 	return result
 }
 
+var errTorrentFileNotFound = errors.New("File not found in torrent")
+
+type TorrentFileSelector struct {
+	Index int    `json:"index"`
+	Path  string `json:"path,omitempty"`
+	Match string `json:"match,omitempty"`
+}
+
+func NewTorrentFileSelector(index int, path string, match string) *TorrentFileSelector {
+	return &TorrentFileSelector{
+		Index: index,
+		Path:  path,
+		Match: match,
+	}
+}
+
+func (tfs *TorrentFileSelector) IsDefault() bool {
+	return tfs == nil || (tfs.Index < 0 && tfs.Path == "" && tfs.Match == "")
+}
+
+// Select resolves the selector against the torrent files, falling back to the
+// first file selected by the magnet link, then to the biggest file, when no
+// selection was made.
+func (tfs *TorrentFileSelector) Select(ti *TorrentInfo) (result *TorrentFileInfo, err error) {
+	switch {
+	case tfs.IsDefault():
+		if result = ti.GetFirstSelectedTorrentFileInfo(); result == nil {
+			result = ti.GetBiggestTorrentFileInfo()
+		}
+	case tfs.Index >= 0:
+		result = ti.GetTorrentFileInfoByIndex(tfs.Index)
+	case tfs.Path != "":
+		result = ti.GetTorrentFileInfo(tfs.Path)
+	default:
+		if result, err = ti.GetTorrentFileInfoByMatch(tfs.Match); err != nil {
+			return nil, err
+		}
+	}
+
+	if result == nil {
+		return nil, errTorrentFileNotFound
+	}
+	return result, nil
+}
+
 type TorrentConnectionInfo struct {
-	connectionChan  chan int
+	mutex sync.Mutex
+
 	ConnectionCount int  `json:"connection_count"`
 	Served          bool `json:"served"`
-	paused          bool
+
+	addedAt    time.Time
+	metadataAt time.Time
+	streams    []*StreamInfo
 }
 
 func NewTorrentConnectionInfo() *TorrentConnectionInfo {
 	return &TorrentConnectionInfo{
-		connectionChan:  make(chan int),
 		ConnectionCount: 0,
 		Served:          false,
-		paused:          false,
+		addedAt:         time.Now(),
 	}
 }
 
+func (tci *TorrentConnectionInfo) MarshalJSON() ([]byte, error) {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	return json.Marshal(map[string]interface{}{
+		"connection_count": tci.ConnectionCount,
+		"served":           tci.Served,
+	})
+}
+
+func (tci *TorrentConnectionInfo) addConnections(delta int) int {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	tci.ConnectionCount += delta
+	return tci.ConnectionCount
+}
+
+func (tci *TorrentConnectionInfo) GetConnectionCount() int {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	return tci.ConnectionCount
+}
+
+// setServed returns true the first time only.
+func (tci *TorrentConnectionInfo) setServed() bool {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	if tci.Served {
+		return false
+	}
+	tci.Served = true
+	return true
+}
+
+// torrentRemoveTimeout bounds the wait for libtorrent removal alerts.
+const torrentRemoveTimeout = 30 * time.Second
+
 type BitTorrent struct {
-	session         libtorrent.Session
-	lookAhead       map[string]float32
-	mixpanelData    map[string]string
-	connectionInfos map[string]*TorrentConnectionInfo
-	removeChan      chan bool
-	deleteChan      chan bool
+	session        libtorrent.Session
+	registry       *TorrentRegistry
+	events         *EventBroker
+	alerts         *AlertDispatcher
+	sessionErrors  *ErrorLog
+	network        *NetworkStatus
+	mutex          sync.Mutex
+	resumeDataChan chan bool
+	stopping       bool
+
+	connectionWatchUntil time.Time
 }
 
 func NewBitTorrent() *BitTorrent {
 	return &BitTorrent{
-		lookAhead:       make(map[string]float32),
-		mixpanelData:    make(map[string]string),
-		connectionInfos: make(map[string]*TorrentConnectionInfo),
-		removeChan:      make(chan bool),
-		deleteChan:      make(chan bool),
+		registry: NewTorrentRegistry(),
+		events:   NewEventBroker(),
+		alerts:   NewAlertDispatcher(),
+
+		sessionErrors: NewErrorLog(),
+		network:       NewNetworkStatus(),
 	}
 }
 
+func (b *BitTorrent) isStopping() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.stopping
+}
+
+// Debug alerts are only enabled while connections are watched, see
+// watchConnections.
+var sessionAlertMask = uint(libtorrent.AlertError_notification | libtorrent.AlertStorage_notification | libtorrent.AlertStatus_notification | libtorrent.AlertTracker_notification | libtorrent.AlertPort_mapping_notification | libtorrent.AlertPeer_notification)
+
 func (b *BitTorrent) Start() {
 	peopleSet()
 
 	fingerprint := libtorrent.NewFingerprint("LT", libtorrent.LIBTORRENT_VERSION_MAJOR, libtorrent.LIBTORRENT_VERSION_MINOR, 0, 0)
 	sessionFlags := int(libtorrent.SessionAdd_default_plugins)
-	alertMask := uint(libtorrent.AlertError_notification | libtorrent.AlertStorage_notification | libtorrent.AlertStatus_notification)
 
 	b.session = libtorrent.NewSession(fingerprint, sessionFlags)
-	b.session.Set_alert_mask(alertMask)
+	b.session.Set_alert_mask(sessionAlertMask)
+	b.registerAlertHandlers()
+	b.registerErrorHandlers()
+	b.registerDiagnosticsHandlers()
 	go b.alertPump()
+	go b.statsPump()
 
 	sessionSettings := b.session.Settings()
 	sessionSettings.SetAnnounce_to_all_tiers(true)
@@ -413,11 +818,28 @@ func (b *BitTorrent) Start() {
 		b.session.Start_upnp()
 		b.session.Start_natpmp()
 	}
+
+	b.loadResumeInfos()
+	if settings.stateDir != "" && settings.resumeDataInterval > 0 {
+		go b.resumeDataPump()
+	}
 }
 
 func (b *BitTorrent) Stop() {
-	for i := 0; i < int(b.session.Get_torrents().Size()); i++ {
-		b.removeTorrent(b.session.Get_torrents().Get(i))
+	b.mutex.Lock()
+	b.stopping = true
+	b.mutex.Unlock()
+
+	// Torrents are restored on next start, keep their files
+	deleteFiles := !settings.keepFiles
+	if settings.stateDir != "" {
+		b.saveAllResumeData()
+		deleteFiles = false
+	}
+
+	handles := b.session.Get_torrents()
+	for i := 0; i < int(handles.Size()); i++ {
+		b.removeTorrent(handles.Get(i), deleteFiles)
 	}
 
 	if settings.uPNPNatPMPEnabled {
@@ -429,29 +851,109 @@ func (b *BitTorrent) Stop() {
 	b.session.Stop_dht()
 }
 
-func (b *BitTorrent) AddTorrent(magnetLink string, downloadDir string, infoHash string, lookAhead float32, mixpanelData string) {
+// AddTorrent fails while libtorrent recently rejected the torrent.
+func (b *BitTorrent) AddTorrent(magnet *Magnet, downloadDir string, lookAhead float32, fileSelector *TorrentFileSelector, mixpanelData string) error {
+	if torrentError := b.registry.GetAddFailure(magnet.InfoHash); torrentError != nil {
+		return torrentError
+	}
+
+	addTorrentParams := libtorrent.NewAdd_torrent_params()
+	magnet.setAddTorrentParams(addTorrentParams)
+	if !b.HasTorrent(magnet.InfoHash) {
+		if torrentInfo := loadCachedMetadata(magnet.InfoHash); torrentInfo != nil {
+			addTorrentParams.SetTi(torrentInfo)
+		}
+	}
+	b.saveResumeInfo(magnet.InfoHash, &TorrentResumeInfo{MagnetLink: magnet.Link, DownloadDir: downloadDir, LookAhead: lookAhead, FileSelector: fileSelector, MixpanelData: mixpanelData}, nil)
+	b.addTorrent(addTorrentParams, downloadDir, magnet.InfoHash, magnet, lookAhead, fileSelector, nil, mixpanelData)
+	return nil
+}
+
+func (b *BitTorrent) AddTorrentFile(torrentData []byte, downloadDir string, lookAhead float32, fileSelector *TorrentFileSelector, mixpanelData string) (string, error) {
+	infoHash, err := getTorrentFileInfoHash(torrentData)
+	if err != nil {
+		return "", err
+	}
+
+	if torrentError := b.registry.GetAddFailure(infoHash); torrentError != nil {
+		return infoHash, torrentError
+	}
+
+	torrentInfo, err := newTorrentInfo(torrentData)
+	if err != nil {
+		return "", err
+	}
+
 	addTorrentParams := libtorrent.NewAdd_torrent_params()
-	addTorrentParams.SetUrl(magnetLink)
+	addTorrentParams.SetTi(torrentInfo)
+	b.saveResumeInfo(infoHash, &TorrentResumeInfo{DownloadDir: downloadDir, LookAhead: lookAhead, FileSelector: fileSelector, MixpanelData: mixpanelData}, torrentData)
+	b.addTorrent(addTorrentParams, downloadDir, infoHash, nil, lookAhead, fileSelector, nil, mixpanelData)
+	return infoHash, nil
+}
+
+func newTorrentInfo(torrentData []byte) (libtorrent.Torrent_info, error) {
+	ec := libtorrent.NewError_code()
+	torrentInfo := libtorrent.NewTorrent_info(string(torrentData), len(torrentData), ec)
+	if ec.Value() != 0 {
+		return nil, errors.New(ec.Message())
+	}
+	return torrentInfo, nil
+}
+
+// addTorrent is given the magnet of torrents not added from a .torrent file.
+func (b *BitTorrent) addTorrent(addTorrentParams libtorrent.Add_torrent_params, downloadDir string, infoHash string, magnet *Magnet, lookAhead float32, fileSelector *TorrentFileSelector, filePriorities map[int]int, mixpanelData string) {
 	addTorrentParams.SetSave_path(downloadDir)
 	addTorrentParams.SetStorage_mode(libtorrent.Storage_mode_sparse)
 	addTorrentParams.SetFlags(0)
 
-	if _, ok := b.lookAhead[infoHash]; !ok {
-		b.lookAhead[infoHash] = lookAhead
+	// A torrent being removed is added again once gone
+	for {
+		entry, waitChan := b.registry.Add(infoHash, magnet, lookAhead, fileSelector, filePriorities, mixpanelData)
+		if waitChan != nil {
+			<-waitChan
+			continue
+		}
+		if entry == nil {
+			b.updateFileSelector(infoHash, fileSelector)
+			return
+		}
+		break
 	}
 
-	if _, ok := b.mixpanelData[infoHash]; !ok {
-		b.mixpanelData[infoHash] = mixpanelData
+	b.session.Async_add_torrent(addTorrentParams)
+}
+
+// updateFileSelector prioritizes the file a later request selects, the last
+// selection wins. Default selections keep the current one.
+func (b *BitTorrent) updateFileSelector(infoHash string, fileSelector *TorrentFileSelector) {
+	if fileSelector.IsDefault() || !b.registry.SetFileSelector(infoHash, fileSelector) {
+		return
 	}
+	b.saveFileSelector(infoHash, fileSelector)
 
-	b.session.Async_add_torrent(addTorrentParams)
+	// Files other clients stream keep their priority, the policy defaults
+	// were applied once on metadata
+	torrentInfo := b.GetTorrentInfo(infoHash)
+	if torrentInfo == nil || len(torrentInfo.Files) == 0 {
+		return
+	}
+	if torrentFileInfo, err := fileSelector.Select(torrentInfo); err == nil {
+		torrentFileInfo.SetInitialPriority()
+	}
+}
+
+// HasTorrent reports whether the torrent was added, even if libtorrent has
+// not acknowledged it yet.
+func (b *BitTorrent) HasTorrent(infoHash string) bool {
+	_, ok := b.registry.Get(infoHash)
+	return ok
 }
 
 func (b *BitTorrent) GetTorrentInfos() (result []*TorrentInfo) {
 	result = make([]*TorrentInfo, 0, 0)
 	handles := b.session.Get_torrents()
 	for i := 0; i < int(handles.Size()); i++ {
-		if _, ok := b.connectionInfos[b.getTorrentInfoHash(handles.Get(i))]; ok {
+		if b.registry.IsActive(b.getTorrentInfoHash(handles.Get(i))) {
 			result = append(result, NewTorrentInfo(handles.Get(i)))
 		}
 	}
@@ -462,7 +964,7 @@ func (b *BitTorrent) GetTorrentInfo(infoHash string) *TorrentInfo {
 	handles := b.session.Get_torrents()
 	for i := 0; i < int(handles.Size()); i++ {
 		if infoHash == b.getTorrentInfoHash(handles.Get(i)) {
-			if _, ok := b.connectionInfos[infoHash]; ok {
+			if b.registry.IsActive(infoHash) {
 				return NewTorrentInfo(handles.Get(i))
 			}
 		}
@@ -470,18 +972,83 @@ func (b *BitTorrent) GetTorrentInfo(infoHash string) *TorrentInfo {
 	return nil
 }
 
+func (b *BitTorrent) PauseTorrent(infoHash string) bool {
+	if handle, ok := b.getTorrentHandle(infoHash); ok {
+		b.pauseTorrent(handle)
+		return true
+	}
+	return false
+}
+
+func (b *BitTorrent) ResumeTorrent(infoHash string) bool {
+	if handle, ok := b.getTorrentHandle(infoHash); ok {
+		b.resumeTorrent(handle)
+		return true
+	}
+	return false
+}
+
+func (b *BitTorrent) RecheckTorrent(infoHash string) bool {
+	if handle, ok := b.getTorrentHandle(infoHash); ok {
+		handle.Force_recheck()
+		return true
+	}
+	return false
+}
+
+// RemoveTorrent also succeeds while the torrent is already being removed.
+func (b *BitTorrent) RemoveTorrent(infoHash string, deleteFiles bool) bool {
+	handles := b.session.Get_torrents()
+	for i := 0; i < int(handles.Size()); i++ {
+		if infoHash == b.getTorrentInfoHash(handles.Get(i)) {
+			return b.removeTorrent(handles.Get(i), deleteFiles)
+		}
+	}
+	return false
+}
+
 func (b *BitTorrent) AddConnection(infoHash string) {
-	b.connectionInfos[infoHash].connectionChan <- 1
+	b.sendConnection(infoHash, 1)
 }
 
 func (b *BitTorrent) RemoveConnection(infoHash string) {
-	b.connectionInfos[infoHash].connectionChan <- -1
+	b.sendConnection(infoHash, -1)
+}
+
+// sendConnection gives up once the torrent is gone, it may have been removed
+// while streaming.
+func (b *BitTorrent) sendConnection(infoHash string, delta int) {
+	if entry, ok := b.registry.Get(infoHash); ok {
+		select {
+		case entry.connectionChan <- delta:
+		case <-entry.doneChan:
+		}
+	}
+}
+
+func (b *BitTorrent) getTorrentHandle(infoHash string) (libtorrent.Torrent_handle, bool) {
+	handles := b.session.Get_torrents()
+	for i := 0; i < int(handles.Size()); i++ {
+		if infoHash == b.getTorrentInfoHash(handles.Get(i)) {
+			if b.registry.IsActive(infoHash) {
+				return handles.Get(i), true
+			}
+		}
+	}
+	return nil, false
 }
 
 func (b *BitTorrent) getTorrentInfoHash(handle libtorrent.Torrent_handle) string {
 	return fmt.Sprintf("%X", handle.Info_hash().To_string())
 }
 
+var infoHashRegExp = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+// isInfoHash checks infoHash has the format returned by getTorrentInfoHash.
+func isInfoHash(infoHash string) bool {
+	return infoHashRegExp.MatchString(infoHash)
+}
+
 func (b *BitTorrent) pauseTorrent(handle libtorrent.Torrent_handle) {
 	handle.Pause()
 }
@@ -490,177 +1057,258 @@ func (b *BitTorrent) resumeTorrent(handle libtorrent.Torrent_handle) {
 	handle.Resume()
 }
 
-func (b *BitTorrent) removeTorrent(handle libtorrent.Torrent_handle) {
-	removeFlags := 0
-	if !settings.keepFiles {
-		removeFlags |= int(libtorrent.SessionDelete_files)
+// removeTorrent returns once libtorrent removed the torrent, and deleted its
+// files when asked. Overlapping removals of a torrent all wait for the first.
+func (b *BitTorrent) removeTorrent(handle libtorrent.Torrent_handle, deleteFiles bool) bool {
+	entry, first, deleteFiles := b.registry.BeginRemove(b.getTorrentInfoHash(handle), deleteFiles)
+	if entry == nil {
+		return false
 	}
 
-	b.session.Remove_torrent(handle, removeFlags)
-	<-b.removeChan
+	if first {
+		// Already removed, no alert would ever be received
+		if !handle.Is_valid() {
+			b.registry.Forget(entry)
+			return true
+		}
 
-	if (removeFlags & int(libtorrent.SessionDelete_files)) != 0 {
-		<-b.deleteChan
+		removeFlags := 0
+		if deleteFiles {
+			removeFlags |= int(libtorrent.SessionDelete_files)
+		}
+		b.session.Remove_torrent(handle, removeFlags)
 	}
+
+	select {
+	case <-entry.doneChan:
+	case <-time.After(torrentRemoveTimeout):
+		log.Printf("[scrapmagnet] Timed out removing %v", entry.infoHash)
+		b.registry.Forget(entry)
+	}
+	return true
 }
 
 func (b *BitTorrent) alertPump() {
 	for {
 		if b.session.Wait_for_alert(libtorrent.Seconds(1)).Swigcptr() != 0 {
-			alert := b.session.Pop_alert()
-			switch alert.Xtype() {
-			case libtorrent.Torrent_added_alertAlert_type:
-				torrentAddedAlert := libtorrent.SwigcptrTorrent_added_alert(alert.Swigcptr())
-				b.onTorrentAdded(torrentAddedAlert.GetHandle())
-			case libtorrent.Metadata_received_alertAlert_type:
-				metadataReceivedAlert := libtorrent.SwigcptrMetadata_received_alert(alert.Swigcptr())
-				b.onMetadataReceived(metadataReceivedAlert.GetHandle())
-			case libtorrent.Torrent_paused_alertAlert_type:
-				torrentPausedAlert := libtorrent.SwigcptrTorrent_paused_alert(alert.Swigcptr())
-				b.onTorrentPaused(torrentPausedAlert.GetHandle())
-			case libtorrent.Torrent_resumed_alertAlert_type:
-				torrentResumedAlert := libtorrent.SwigcptrTorrent_resumed_alert(alert.Swigcptr())
-				b.onTorrentResumed(torrentResumedAlert.GetHandle())
-			case libtorrent.Torrent_finished_alertAlert_type:
-				torrentFinishedAlert := libtorrent.SwigcptrTorrent_finished_alert(alert.Swigcptr())
-				b.onTorrentFinished(torrentFinishedAlert.GetHandle())
-			case libtorrent.Torrent_removed_alertAlert_type:
-				torrentRemovedAlert := libtorrent.SwigcptrTorrent_removed_alert(alert.Swigcptr())
-				b.onTorrentRemoved(torrentRemovedAlert.GetHandle())
-			case libtorrent.Torrent_deleted_alertAlert_type:
-				torrentDeletedAlert := libtorrent.SwigcptrTorrent_deleted_alert(alert.Swigcptr())
-				b.onTorrentDeleted(torrentDeletedAlert.GetInfo_hash().To_string(), true)
-			case libtorrent.Torrent_delete_failed_alertAlert_type:
-				torrentDeletedAlert := libtorrent.SwigcptrTorrent_deleted_alert(alert.Swigcptr())
-				b.onTorrentDeleted(torrentDeletedAlert.GetInfo_hash().To_string(), false)
-			case libtorrent.Listen_succeeded_alertAlert_type:
-				listenSucceedAlert := libtorrent.SwigcptrListen_succeeded_alert(alert.Swigcptr())
-				if listenSucceedAlert.GetSock_type() != libtorrent.Listen_succeeded_alertTcp_ssl && !strings.Contains(listenSucceedAlert.Message(), "[::]") {
-					log.Printf("[scrapmagnet] %s", listenSucceedAlert.Message())
-				}
-			case libtorrent.Add_torrent_alertAlert_type:
-				// Ignore
-			case libtorrent.Torrent_checked_alertAlert_type:
-				// Ignore
-			case libtorrent.State_changed_alertAlert_type:
-				// Ignore
-			case libtorrent.Hash_failed_alertAlert_type:
-				// Ignore
-			case libtorrent.Cache_flushed_alertAlert_type:
-				// Ignore
-			case libtorrent.External_ip_alertAlert_type:
-				// Ignore
-			case libtorrent.Portmap_error_alertAlert_type:
-				// Ignore
-			case libtorrent.Tracker_error_alertAlert_type:
-				// Ignore
-			case libtorrent.Udp_error_alertAlert_type:
-				// Ignore
-			default:
-				log.Printf("[scrapmagnet] %s: %s", alert.What(), alert.Message())
+			alert := decodeAlert(b.session.Pop_alert())
+			metrics.IncAlert(alert.Type)
+			if !b.alerts.Dispatch(alert) {
+				logUnhandledAlert(alert)
 			}
 		}
 	}
 }
 
+func (b *BitTorrent) registerAlertHandlers() {
+	b.alerts.Handle(libtorrent.Torrent_added_alertAlert_type, func(alert *Alert) {
+		b.onTorrentAdded(alert.Handle())
+	})
+	b.alerts.Handle(libtorrent.Metadata_received_alertAlert_type, func(alert *Alert) {
+		b.onMetadataReceived(alert.Handle())
+	})
+	b.alerts.Handle(libtorrent.Torrent_paused_alertAlert_type, func(alert *Alert) {
+		b.onTorrentPaused(alert.Handle())
+	})
+	b.alerts.Handle(libtorrent.Torrent_resumed_alertAlert_type, func(alert *Alert) {
+		b.onTorrentResumed(alert.Handle())
+	})
+	b.alerts.Handle(libtorrent.Torrent_finished_alertAlert_type, func(alert *Alert) {
+		b.onTorrentFinished(alert.Handle())
+	})
+	b.alerts.Handle(libtorrent.Torrent_removed_alertAlert_type, func(alert *Alert) {
+		b.onTorrentRemoved(alert.Handle())
+	})
+	b.alerts.Handle(libtorrent.Torrent_deleted_alertAlert_type, func(alert *Alert) {
+		b.onTorrentDeleted(alert.InfoHash, true)
+	})
+	b.alerts.Handle(libtorrent.Torrent_delete_failed_alertAlert_type, func(alert *Alert) {
+		b.onTorrentDeleteFailed(alert.InfoHash, alert.Data.(*ErrorAlert).Error)
+	})
+	b.alerts.Handle(libtorrent.Save_resume_data_alertAlert_type, func(alert *Alert) {
+		b.onSaveResumeData(alert.Handle(), alert.Data.(*SaveResumeDataAlert).resumeData)
+	})
+	b.alerts.Handle(libtorrent.Save_resume_data_failed_alertAlert_type, func(alert *Alert) {
+		log.Printf("[scrapmagnet] %s", alert.Message)
+		b.onResumeDataDone()
+	})
+	b.alerts.Handle(libtorrent.Listen_succeeded_alertAlert_type, func(alert *Alert) {
+		if alert.Data.(*ListenAlert).SockType != int(libtorrent.Listen_succeeded_alertTcp_ssl) && !strings.Contains(alert.Message, "[::]") {
+			log.Printf("[scrapmagnet] %s", alert.Message)
+		}
+	})
+	b.alerts.Handle(libtorrent.Hash_failed_alertAlert_type, func(alert *Alert) {
+		metrics.IncHashFailure(alert.InfoHash)
+	})
+	b.alerts.Handle(libtorrent.Tracker_error_alertAlert_type, func(alert *Alert) {
+		b.onTrackerError(alert)
+	})
+}
+
 func (b *BitTorrent) onTorrentAdded(handle libtorrent.Torrent_handle) {
 	infoHash := b.getTorrentInfoHash(handle)
 
-	b.connectionInfos[infoHash] = NewTorrentConnectionInfo()
+	entry, ok := b.registry.Get(infoHash)
+	if !ok {
+		log.Printf("[scrapmagnet] Unknown torrent added %v", infoHash)
+		return
+	}
+	b.registry.OnAdded(infoHash, handle.Torrent_file().Swigcptr() != 0)
+	go b.inactivityWatcher(handle, entry)
+	if entry.magnet != nil && len(entry.magnet.Peers) > 0 {
+		go entry.magnet.connectPeers(handle)
+	}
+
+	// Torrents added from a .torrent file never receive a metadata alert
+	if handle.Torrent_file().Swigcptr() != 0 {
+		b.setInitialPriority(handle)
+	}
+
+	log.Printf("[scrapmagnet] Added %v", handle.Status().GetName())
+	b.events.Publish("added", handle, nil)
+	trackingEvent("Added", map[string]interface{}{"Magnet InfoHash": b.getTorrentInfoHash(handle), "Magnet Name": handle.Status().GetName()}, entry.mixpanelData)
+}
+
+// inactivityWatcher owns the connection count of a torrent. Once the last
+// connection is gone the torrent is paused, then removed. Torrents nobody
+// connects to, ex: added through the API or restored, are paused as well.
+func (b *BitTorrent) inactivityWatcher(handle libtorrent.Torrent_handle, entry *torrentEntry) {
+	var pauseChan, removeChan <-chan time.Time
+	paused := false
 
-	go func() {
-		watcherRunning := false
-		resumeChan := make(chan bool)
+	if entry.connectionInfo.GetConnectionCount() == 0 {
+		pauseChan = time.After(time.Duration(settings.inactivityPauseTimeout) * time.Second)
+	}
 
-		// Auto pause/remove
-		for {
-			b.connectionInfos[infoHash].ConnectionCount += <-b.connectionInfos[infoHash].connectionChan
-			if b.connectionInfos[infoHash].ConnectionCount > 0 {
-				if watcherRunning {
-					resumeChan <- true
+	for {
+		select {
+		case <-entry.doneChan:
+			return
+		case delta := <-entry.connectionChan:
+			if entry.connectionInfo.addConnections(delta) > 0 {
+				pauseChan, removeChan = nil, nil
+				if paused {
+					b.resumeTorrent(handle)
+					paused = false
 				}
-			} else {
-				go func() {
-					watcherRunning = true
-					paused := false
-				Watcher:
-					for {
-						if !paused {
-							select {
-							case <-resumeChan:
-								break Watcher
-							case <-time.After(time.Duration(settings.inactivityPauseTimeout) * time.Second):
-								b.pauseTorrent(handle)
-								paused = true
-							}
-						} else {
-							select {
-							case <-resumeChan:
-								b.resumeTorrent(handle)
-								break Watcher
-							case <-time.After(time.Duration(settings.inactivityRemoveTimeout) * time.Second):
-								b.removeTorrent(handle)
-								break Watcher
-							}
-						}
-					}
-					watcherRunning = false
-				}()
+			} else if pauseChan == nil && removeChan == nil {
+				pauseChan = time.After(time.Duration(settings.inactivityPauseTimeout) * time.Second)
 			}
+		case <-pauseChan:
+			pauseChan = nil
+			b.pauseTorrent(handle)
+			paused = true
+			removeChan = time.After(time.Duration(settings.inactivityRemoveTimeout) * time.Second)
+		case <-removeChan:
+			b.removeTorrent(handle, !settings.keepFiles)
+			return
 		}
-	}()
-
-	log.Printf("[scrapmagnet] Added %v", handle.Status().GetName())
-	trackingEvent("Added", map[string]interface{}{"Magnet InfoHash": b.getTorrentInfoHash(handle), "Magnet Name": handle.Status().GetName()}, b.mixpanelData[infoHash])
+	}
 }
 
 func (b *BitTorrent) onMetadataReceived(handle libtorrent.Torrent_handle) {
-	torrentInfo := b.GetTorrentInfo(b.getTorrentInfoHash(handle))
-	for i := 0; i < len(torrentInfo.Files); i++ {
-		torrentInfo.Files[i].SetInitialPriority()
-	}
+	b.registry.OnMetadata(b.getTorrentInfoHash(handle))
+	b.setInitialPriority(handle)
+	cacheMetadata(b.getTorrentInfoHash(handle), handle.Torrent_file())
 
 	log.Printf("[scrapmagnet] Metadata received %v", handle.Status().GetName())
-	trackingEvent("Metadata received", map[string]interface{}{"Magnet InfoHash": b.getTorrentInfoHash(handle), "Magnet Name": handle.Status().GetName()}, b.mixpanelData[b.getTorrentInfoHash(handle)])
+	b.events.Publish("metadata_received", handle, nil)
+	trackingEvent("Metadata received", map[string]interface{}{"Magnet InfoHash": b.getTorrentInfoHash(handle), "Magnet Name": handle.Status().GetName()}, b.getMixpanelData(handle))
+}
+
+func (b *BitTorrent) setInitialPriority(handle libtorrent.Torrent_handle) {
+	infoHash := b.getTorrentInfoHash(handle)
+	entry, ok := b.registry.Get(infoHash)
+	if !ok {
+		return
+	}
+	entry.connectionInfo.onMetadata()
+
+	torrentInfo := b.GetTorrentInfo(infoHash)
+	if torrentInfo == nil {
+		return
+	}
+	torrentFileInfo, err := b.registry.GetFileSelector(entry).Select(torrentInfo)
+	if err != nil {
+		log.Printf("[scrapmagnet] No file to prioritize in %v: %v", handle.Status().GetName(), err)
+	}
+
+	var selectOnly []int
+	if entry.magnet != nil {
+		selectOnly = entry.magnet.SelectOnly
+	}
+	prioritizeFiles(handle, entry.filePriorities.reset(getDefaultFilePriorities(torrentInfo, selectOnly, torrentFileInfo)))
+
+	if torrentFileInfo != nil {
+		torrentFileInfo.SetInitialPriority()
+	}
 }
 
 func (b *BitTorrent) onTorrentPaused(handle libtorrent.Torrent_handle) {
-	if !b.connectionInfos[b.getTorrentInfoHash(handle)].paused {
+	if b.registry.Transition(b.getTorrentInfoHash(handle), TorrentPaused) {
 		log.Printf("[scrapmagnet] Paused %v", handle.Status().GetName())
-		b.connectionInfos[b.getTorrentInfoHash(handle)].paused = true
+		b.events.Publish("paused", handle, nil)
 	}
 }
 
 func (b *BitTorrent) onTorrentResumed(handle libtorrent.Torrent_handle) {
-	if b.connectionInfos[b.getTorrentInfoHash(handle)].paused {
+	if b.registry.OnResumed(b.getTorrentInfoHash(handle)) {
 		log.Printf("[scrapmagnet] Resumed %v", handle.Status().GetName())
-		b.connectionInfos[b.getTorrentInfoHash(handle)].paused = false
+		b.events.Publish("resumed", handle, nil)
 	}
 }
 
 func (b *BitTorrent) onTorrentFinished(handle libtorrent.Torrent_handle) {
 	log.Printf("[scrapmagnet] Finished %v", handle.Status().GetName())
-	trackingEvent("Finished", map[string]interface{}{"Magnet InfoHash": b.getTorrentInfoHash(handle), "Magnet Name": handle.Status().GetName()}, b.mixpanelData[b.getTorrentInfoHash(handle)])
+	b.events.Publish("finished", handle, b.GetTorrentInfo(b.getTorrentInfoHash(handle)))
+	trackingEvent("Finished", map[string]interface{}{"Magnet InfoHash": b.getTorrentInfoHash(handle), "Magnet Name": handle.Status().GetName()}, b.getMixpanelData(handle))
 }
 
 func (b *BitTorrent) onTorrentRemoved(handle libtorrent.Torrent_handle) {
+	infoHash := b.getTorrentInfoHash(handle)
+
 	log.Printf("[scrapmagnet] Removed %v", handle.Status().GetName())
-	trackingEvent("Removed", map[string]interface{}{"Magnet InfoHash": b.getTorrentInfoHash(handle), "Magnet Name": handle.Status().GetName()}, b.mixpanelData[b.getTorrentInfoHash(handle)])
 
-	delete(b.mixpanelData, b.getTorrentInfoHash(handle))
-	delete(b.lookAhead, b.getTorrentInfoHash(handle))
-	delete(b.connectionInfos, b.getTorrentInfoHash(handle))
-	b.removeChan <- true
+	// Torrents removed on shutdown are restored on next start
+	if !b.isStopping() || settings.stateDir == "" {
+		b.events.Publish("removed", handle, nil)
+		trackingEvent("Removed", map[string]interface{}{"Magnet InfoHash": infoHash, "Magnet Name": handle.Status().GetName()}, b.getMixpanelData(handle))
+	}
+	if !b.isStopping() {
+		b.deleteResumeInfo(infoHash)
+	}
+
+	metrics.RemoveTorrent(infoHash)
+	b.registry.OnRemoved(infoHash)
 }
 
-func (b *BitTorrent) onTorrentDeleted(infoHash string, success bool) {
-	b.deleteChan <- success
+func (b *BitTorrent) getMixpanelData(handle libtorrent.Torrent_handle) string {
+	if entry, ok := b.registry.Lookup(b.getTorrentInfoHash(handle)); ok {
+		return entry.mixpanelData
+	}
+	return ""
+}
 
-	{
-		if success {
-			log.Printf("[scrapmagnet] Deleted")
-		} else {
-			log.Printf("[scrapmagnet] Delete failed")
-		}
+func (b *BitTorrent) onTorrentDeleted(infoHash string, success bool) {
+	if success {
+		log.Printf("[scrapmagnet] Deleted %v", infoHash)
+	} else {
+		log.Printf("[scrapmagnet] Delete failed %v", infoHash)
 	}
+	b.registry.OnDeleted(infoHash)
+}
+
+func (b *BitTorrent) onTorrentDeleteFailed(infoHash string, errorMessage string) {
+	b.onTorrentDeleted(infoHash, false)
+	b.events.PublishInfoHash("delete_failed", infoHash, map[string]interface{}{"error": errorMessage})
+}
+
+func (b *BitTorrent) onTrackerError(alert *Alert) {
+	trackerErrorAlert := alert.Data.(*TrackerErrorAlert)
+	b.events.Publish("tracker_error", alert.Handle(), map[string]interface{}{
+		"url":          trackerErrorAlert.URL,
+		"times_in_row": trackerErrorAlert.TimesInRow,
+		"status_code":  trackerErrorAlert.StatusCode,
+		"message":      alert.Message,
+	})
 }
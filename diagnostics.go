@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drone/routes"
+	"github.com/sharkone/libtorrent-go"
+)
+
+const connectionWatchDelay = 10 * time.Minute
+
+// TorrentActivity records what libtorrent doesn't keep about a torrent:
+// connection attempts, tracker replies and the pieces readers wait for.
+type TorrentActivity struct {
+	mutex           sync.Mutex
+	connectAttempts int
+	connectFailures int
+	failureReasons  map[string]int
+	trackerReplies  map[string]*TrackerReply
+	pieceWaits      map[int]*pieceWait
+}
+
+type TrackerReply struct {
+	Time  time.Time `json:"time"`
+	Peers int       `json:"peers"`
+}
+
+type pieceWait struct {
+	since   time.Time
+	waiters int
+}
+
+func NewTorrentActivity() *TorrentActivity {
+	return &TorrentActivity{
+		failureReasons: make(map[string]int),
+		trackerReplies: make(map[string]*TrackerReply),
+		pieceWaits:     make(map[int]*pieceWait),
+	}
+}
+
+func (ta *TorrentActivity) onConnectAttempt() {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	ta.connectAttempts++
+}
+
+func (ta *TorrentActivity) onConnectFailure(reason string) {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	ta.connectFailures++
+	ta.failureReasons[reason]++
+}
+
+func (ta *TorrentActivity) onTrackerReply(url string, peers int) {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	ta.trackerReplies[url] = &TrackerReply{Time: time.Now(), Peers: peers}
+}
+
+// beginPieceWait returns the function to call once the piece arrived or the
+// reader gave up.
+func (ta *TorrentActivity) beginPieceWait(pieceIndex int) func() {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	wait, ok := ta.pieceWaits[pieceIndex]
+	if !ok {
+		wait = &pieceWait{since: time.Now()}
+		ta.pieceWaits[pieceIndex] = wait
+	}
+	wait.waiters++
+
+	return func() {
+		ta.mutex.Lock()
+		defer ta.mutex.Unlock()
+
+		if wait.waiters--; wait.waiters == 0 {
+			delete(ta.pieceWaits, pieceIndex)
+		}
+	}
+}
+
+// snapshot copies the activity so libtorrent can be queried without holding
+// the mutex.
+func (ta *TorrentActivity) snapshot() *TorrentActivity {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	result := NewTorrentActivity()
+	result.connectAttempts = ta.connectAttempts
+	result.connectFailures = ta.connectFailures
+	for reason, count := range ta.failureReasons {
+		result.failureReasons[reason] = count
+	}
+	for url, trackerReply := range ta.trackerReplies {
+		reply := *trackerReply
+		result.trackerReplies[url] = &reply
+	}
+	for pieceIndex, wait := range ta.pieceWaits {
+		pieceWait := *wait
+		result.pieceWaits[pieceIndex] = &pieceWait
+	}
+	return result
+}
+
+// NetworkStatus tracks whether the session can be reached by other peers.
+type NetworkStatus struct {
+	mutex      sync.Mutex
+	listen     map[string]*ListenStatus
+	portmaps   map[int]*PortmapStatus
+	externalIp string
+}
+
+type ListenStatus struct {
+	Time     time.Time `json:"time"`
+	SockType int       `json:"sock_type"`
+	Message  string    `json:"message"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type PortmapStatus struct {
+	Time         time.Time `json:"time"`
+	Mapping      int       `json:"mapping"`
+	MapType      string    `json:"map_type"`
+	ExternalPort int       `json:"external_port,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+func NewNetworkStatus() *NetworkStatus {
+	return &NetworkStatus{
+		listen:   make(map[string]*ListenStatus),
+		portmaps: make(map[int]*PortmapStatus),
+	}
+}
+
+func getPortmapTypeStr(mapType int) string {
+	switch mapType {
+	case 0:
+		return "natpmp"
+	case 1:
+		return "upnp"
+	}
+	return "unknown"
+}
+
+func (ns *NetworkStatus) onListen(message string, listenAlert *ListenAlert) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	ns.listen[message] = &ListenStatus{Time: time.Now(), SockType: listenAlert.SockType, Message: message, Error: listenAlert.Error}
+}
+
+func (ns *NetworkStatus) onPortmap(mapping int, mapType int, externalPort int, err string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	ns.portmaps[mapping] = &PortmapStatus{Time: time.Now(), Mapping: mapping, MapType: getPortmapTypeStr(mapType), ExternalPort: externalPort, Error: err}
+}
+
+func (ns *NetworkStatus) onExternalIp(address string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	ns.externalIp = address
+}
+
+// watchConnections enables the debug alerts raised on every peer connection
+// for connectionWatchDelay, they are too many to keep enabled.
+func (b *BitTorrent) watchConnections() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.stopping {
+		return
+	}
+	if b.connectionWatchUntil.IsZero() {
+		log.Print("[scrapmagnet] Watching peer connections")
+		b.session.Set_alert_mask(sessionAlertMask | uint(libtorrent.AlertDebug_notification))
+		time.AfterFunc(connectionWatchDelay, b.unwatchConnections)
+	}
+	b.connectionWatchUntil = time.Now().Add(connectionWatchDelay)
+}
+
+func (b *BitTorrent) unwatchConnections() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if remaining := b.connectionWatchUntil.Sub(time.Now()); remaining > 0 {
+		time.AfterFunc(remaining, b.unwatchConnections)
+		return
+	}
+	b.connectionWatchUntil = time.Time{}
+	if !b.stopping {
+		log.Print("[scrapmagnet] Stopped watching peer connections")
+		b.session.Set_alert_mask(sessionAlertMask)
+	}
+}
+
+func (b *BitTorrent) registerDiagnosticsHandlers() {
+	b.alerts.Handle(libtorrent.Peer_connect_alertAlert_type, func(alert *Alert) {
+		if entry, ok := b.registry.Get(alert.InfoHash); ok {
+			entry.activity.onConnectAttempt()
+		}
+	})
+	b.alerts.Handle(libtorrent.Peer_disconnected_alertAlert_type, func(alert *Alert) {
+		if message := alert.Data.(*PeerErrorAlert).Error; message != "" {
+			if entry, ok := b.registry.Get(alert.InfoHash); ok {
+				entry.activity.onConnectFailure(message)
+			}
+		}
+	})
+	b.alerts.Handle(libtorrent.Peer_error_alertAlert_type, func(alert *Alert) {
+		if entry, ok := b.registry.Get(alert.InfoHash); ok {
+			entry.activity.onConnectFailure(alert.Data.(*PeerErrorAlert).Error)
+		}
+	})
+	b.alerts.Handle(libtorrent.Tracker_reply_alertAlert_type, func(alert *Alert) {
+		trackerReplyAlert := alert.Data.(*TrackerReplyAlert)
+		if entry, ok := b.registry.Get(alert.InfoHash); ok {
+			entry.activity.onTrackerReply(trackerReplyAlert.URL, trackerReplyAlert.Peers)
+		}
+	})
+	b.alerts.Handle(libtorrent.Listen_succeeded_alertAlert_type, func(alert *Alert) {
+		b.network.onListen(alert.Message, alert.Data.(*ListenAlert))
+	})
+	b.alerts.Handle(libtorrent.Listen_failed_alertAlert_type, func(alert *Alert) {
+		b.network.onListen(alert.Message, alert.Data.(*ListenAlert))
+	})
+	b.alerts.Handle(libtorrent.Portmap_alertAlert_type, func(alert *Alert) {
+		portmapAlert := alert.Data.(*PortmapAlert)
+		b.network.onPortmap(portmapAlert.Mapping, portmapAlert.MapType, portmapAlert.ExternalPort, "")
+	})
+	b.alerts.Handle(libtorrent.Portmap_error_alertAlert_type, func(alert *Alert) {
+		portmapErrorAlert := alert.Data.(*PortmapErrorAlert)
+		b.network.onPortmap(portmapErrorAlert.Mapping, portmapErrorAlert.MapType, 0, portmapErrorAlert.Error)
+	})
+	b.alerts.Handle(libtorrent.External_ip_alertAlert_type, func(alert *Alert) {
+		b.network.onExternalIp(alert.Data.(*ExternalIpAlert).Address)
+	})
+}
+
+type TorrentDiagnostics struct {
+	InfoHash    string `json:"info_hash"`
+	Lifecycle   string `json:"lifecycle"`
+	State       string `json:"state"`
+	Paused      bool   `json:"paused"`
+	HasMetadata bool   `json:"has_metadata"`
+
+	DHT           DHTDiagnostics        `json:"dht"`
+	Trackers      []*TrackerDiagnostics `json:"trackers"`
+	Peers         PeerDiagnostics       `json:"peers"`
+	Connections   ConnectionDiagnostics `json:"connections"`
+	Network       NetworkDiagnostics    `json:"network"`
+	BlockedPieces []*BlockedPiece       `json:"blocked_pieces"`
+	Hints         []string              `json:"hints"`
+}
+
+type DHTDiagnostics struct {
+	Running bool `json:"running"`
+	Nodes   int  `json:"nodes"`
+}
+
+type TrackerDiagnostics struct {
+	URL              string        `json:"url"`
+	Tier             int           `json:"tier"`
+	Working          bool          `json:"working"`
+	Verified         bool          `json:"verified"`
+	Updating         bool          `json:"updating"`
+	Fails            int           `json:"fails"`
+	NextAnnounceIn   int           `json:"next_announce_in"`
+	MinAnnounceIn    int           `json:"min_announce_in"`
+	Message          string        `json:"message,omitempty"`
+	LastError        string        `json:"last_error,omitempty"`
+	ScrapeComplete   int           `json:"scrape_complete"`
+	ScrapeIncomplete int           `json:"scrape_incomplete"`
+	LastReply        *TrackerReply `json:"last_reply,omitempty"`
+}
+
+type PeerDiagnostics struct {
+	Connected         int            `json:"connected"`
+	Seeds             int            `json:"seeds"`
+	Known             int            `json:"known"`
+	KnownSeeds        int            `json:"known_seeds"`
+	ConnectCandidates int            `json:"connect_candidates"`
+	BySource          map[string]int `json:"by_source"`
+}
+
+// ConnectionDiagnostics only counts the connection attempts made since the
+// first diagnostics request of the last connectionWatchDelay.
+type ConnectionDiagnostics struct {
+	Attempts       int            `json:"attempts"`
+	Failures       int            `json:"failures"`
+	FailureReasons map[string]int `json:"failure_reasons"`
+}
+
+type NetworkDiagnostics struct {
+	Listening           bool             `json:"listening"`
+	ListenPort          int              `json:"listen_port"`
+	IncomingConnections bool             `json:"incoming_connections"`
+	ExternalIp          string           `json:"external_ip,omitempty"`
+	Listen              []*ListenStatus  `json:"listen"`
+	Portmaps            []*PortmapStatus `json:"portmaps"`
+}
+
+type BlockedPiece struct {
+	Piece        int     `json:"piece"`
+	Waiters      int     `json:"waiters"`
+	WaitingFor   float64 `json:"waiting_for"`
+	Have         bool    `json:"have"`
+	Availability int     `json:"availability"`
+}
+
+var peerSourceNames = []struct {
+	flag int
+	name string
+}{
+	{int(libtorrent.Peer_infoTracker), "tracker"},
+	{int(libtorrent.Peer_infoDht), "dht"},
+	{int(libtorrent.Peer_infoPex), "pex"},
+	{int(libtorrent.Peer_infoLsd), "lsd"},
+	{int(libtorrent.Peer_infoResume_data), "resume_data"},
+	{int(libtorrent.Peer_infoIncoming), "incoming"},
+}
+
+func (b *BitTorrent) GetTorrentDiagnostics(infoHash string) *TorrentDiagnostics {
+	entry, ok := b.registry.Get(infoHash)
+	if !ok {
+		return nil
+	}
+	handle, ok := b.getTorrentHandle(infoHash)
+	if !ok {
+		return nil
+	}
+
+	b.watchConnections()
+
+	torrentStatus := handle.Status()
+	sessionStatus := b.session.Status()
+	result := &TorrentDiagnostics{
+		InfoHash:    infoHash,
+		State:       getTorrentStateStr(torrentStatus.GetState()),
+		Paused:      torrentStatus.GetPaused(),
+		HasMetadata: torrentStatus.GetHas_metadata(),
+		DHT: DHTDiagnostics{
+			Running: b.session.Is_dht_running(),
+			Nodes:   sessionStatus.GetDht_nodes(),
+		},
+		Peers: PeerDiagnostics{
+			Connected:         torrentStatus.GetNum_peers(),
+			Seeds:             torrentStatus.GetNum_seeds(),
+			Known:             torrentStatus.GetList_peers(),
+			KnownSeeds:        torrentStatus.GetList_seeds(),
+			ConnectCandidates: torrentStatus.GetConnect_candidates(),
+			BySource:          make(map[string]int),
+		},
+		Trackers:      make([]*TrackerDiagnostics, 0),
+		BlockedPieces: make([]*BlockedPiece, 0),
+		Hints:         make([]string, 0),
+	}
+	if state, ok := b.registry.GetState(infoHash); ok {
+		result.Lifecycle = state.String()
+	}
+
+	activity := entry.activity.snapshot()
+
+	trackers := handle.Trackers()
+	defer libtorrent.DeleteStdVectorAnnounceEntry(trackers)
+	for i := 0; i < int(trackers.Size()); i++ {
+		announceEntry := trackers.Get(i)
+		trackerDiagnostics := &TrackerDiagnostics{
+			URL:              announceEntry.GetUrl(),
+			Tier:             int(announceEntry.GetTier()),
+			Working:          announceEntry.Is_working(),
+			Verified:         announceEntry.GetVerified(),
+			Updating:         announceEntry.GetUpdating(),
+			Fails:            int(announceEntry.GetFails()),
+			NextAnnounceIn:   announceEntry.Next_announce_in(),
+			MinAnnounceIn:    announceEntry.Min_announce_in(),
+			Message:          announceEntry.GetMessage(),
+			LastError:        getErrorCodeMessage(announceEntry.GetLast_error()),
+			ScrapeComplete:   announceEntry.GetScrape_complete(),
+			ScrapeIncomplete: announceEntry.GetScrape_incomplete(),
+		}
+		if trackerReply, ok := activity.trackerReplies[trackerDiagnostics.URL]; ok {
+			trackerDiagnostics.LastReply = trackerReply
+		}
+		result.Trackers = append(result.Trackers, trackerDiagnostics)
+	}
+
+	for _, peerSourceName := range peerSourceNames {
+		result.Peers.BySource[peerSourceName.name] = 0
+	}
+	peers := libtorrent.NewStdVectorPeerInfo()
+	defer libtorrent.DeleteStdVectorPeerInfo(peers)
+	handle.Get_peer_info(peers)
+	for i := 0; i < int(peers.Size()); i++ {
+		source := peers.Get(i).GetSource()
+		for _, peerSourceName := range peerSourceNames {
+			if source&peerSourceName.flag != 0 {
+				result.Peers.BySource[peerSourceName.name]++
+			}
+		}
+	}
+
+	result.Connections = ConnectionDiagnostics{
+		Attempts:       activity.connectAttempts,
+		Failures:       activity.connectFailures,
+		FailureReasons: activity.failureReasons,
+	}
+
+	if len(activity.pieceWaits) > 0 {
+		availability := libtorrent.NewStdVectorInt()
+		defer libtorrent.DeleteStdVectorInt(availability)
+		handle.Piece_availability(availability)
+		for pieceIndex, wait := range activity.pieceWaits {
+			blockedPiece := &BlockedPiece{
+				Piece:      pieceIndex,
+				Waiters:    wait.waiters,
+				WaitingFor: durationSeconds(time.Since(wait.since)),
+				Have:       handle.Have_piece(pieceIndex),
+			}
+			if pieceIndex < int(availability.Size()) {
+				blockedPiece.Availability = availability.Get(pieceIndex)
+			}
+			result.BlockedPieces = append(result.BlockedPieces, blockedPiece)
+		}
+		sort.Sort(byBlockedPiece(result.BlockedPieces))
+	}
+
+	result.Network = b.getNetworkDiagnostics(sessionStatus)
+	result.Hints = getDiagnosticsHints(result)
+	return result
+}
+
+func (b *BitTorrent) getNetworkDiagnostics(sessionStatus libtorrent.Session_status) NetworkDiagnostics {
+	b.network.mutex.Lock()
+	defer b.network.mutex.Unlock()
+
+	result := NetworkDiagnostics{
+		Listening:           b.session.Is_listening(),
+		ListenPort:          int(b.session.Listen_port()),
+		IncomingConnections: sessionStatus.GetHas_incoming_connections(),
+		ExternalIp:          b.network.externalIp,
+		Listen:              make([]*ListenStatus, 0, len(b.network.listen)),
+		Portmaps:            make([]*PortmapStatus, 0, len(b.network.portmaps)),
+	}
+	for _, listenStatus := range b.network.listen {
+		listen := *listenStatus
+		result.Listen = append(result.Listen, &listen)
+	}
+	for _, portmapStatus := range b.network.portmaps {
+		portmap := *portmapStatus
+		result.Portmaps = append(result.Portmaps, &portmap)
+	}
+	sort.Sort(byListenMessage(result.Listen))
+	sort.Sort(byPortmapMapping(result.Portmaps))
+	return result
+}
+
+// getDiagnosticsHints spells out the usual reasons a torrent makes no
+// progress.
+func getDiagnosticsHints(diagnostics *TorrentDiagnostics) []string {
+	result := make([]string, 0)
+
+	if diagnostics.Paused {
+		result = append(result, "Torrent is paused")
+	}
+	if !diagnostics.DHT.Running {
+		result = append(result, "DHT is disabled")
+	} else if diagnostics.DHT.Nodes == 0 {
+		result = append(result, "DHT has no nodes yet, UDP traffic may be blocked")
+	}
+
+	workingTrackers := 0
+	for _, tracker := range diagnostics.Trackers {
+		if tracker.Working {
+			workingTrackers++
+		}
+	}
+	if len(diagnostics.Trackers) == 0 {
+		result = append(result, "Torrent has no trackers")
+	} else if workingTrackers == 0 {
+		result = append(result, "No tracker answered")
+	}
+
+	if diagnostics.Peers.Known == 0 {
+		result = append(result, "No peer found")
+	} else if diagnostics.Peers.Connected == 0 {
+		result = append(result, fmt.Sprintf("None of the %v known peers could be connected", diagnostics.Peers.Known))
+	}
+	if !diagnostics.HasMetadata && diagnostics.Peers.Connected > 0 {
+		result = append(result, "Connected peers didn't send the metadata yet")
+	}
+
+	if !diagnostics.Network.Listening {
+		result = append(result, "Not listening for incoming connections")
+	} else if !diagnostics.Network.IncomingConnections {
+		result = append(result, "No incoming connection received, the listen port may not be reachable")
+	}
+
+	for _, blockedPiece := range diagnostics.BlockedPieces {
+		if !blockedPiece.Have && blockedPiece.Availability == 0 {
+			result = append(result, fmt.Sprintf("No connected peer has piece %v", blockedPiece.Piece))
+		}
+	}
+	return result
+}
+
+func apiGetTorrentDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if diagnostics := httpInstance.bitTorrent.GetTorrentDiagnostics(getInfoHashParam(r)); diagnostics != nil {
+		routes.ServeJson(w, diagnostics)
+	} else {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+	}
+}
+
+type byBlockedPiece []*BlockedPiece
+
+func (s byBlockedPiece) Len() int           { return len(s) }
+func (s byBlockedPiece) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byBlockedPiece) Less(i, j int) bool { return s[i].Piece < s[j].Piece }
+
+type byListenMessage []*ListenStatus
+
+func (s byListenMessage) Len() int           { return len(s) }
+func (s byListenMessage) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byListenMessage) Less(i, j int) bool { return s[i].Message < s[j].Message }
+
+type byPortmapMapping []*PortmapStatus
+
+func (s byPortmapMapping) Len() int           { return len(s) }
+func (s byPortmapMapping) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPortmapMapping) Less(i, j int) bool { return s[i].Mapping < s[j].Mapping }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/drone/routes"
+	"github.com/sharkone/libtorrent-go"
+)
+
+const (
+	maxTorrentErrors = 50
+	addFailureTTL    = 30 * time.Second
+)
+
+// TorrentError is something that went wrong with a torrent. Identical errors
+// are counted rather than repeated, trackers fail on every announce.
+type TorrentError struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	InfoHash string    `json:"info_hash,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	Message  string    `json:"message"`
+	Count    int       `json:"count"`
+}
+
+func (te *TorrentError) Error() string {
+	return te.Message
+}
+
+func (te *TorrentError) sameAs(other *TorrentError) bool {
+	return te.Source == other.Source && te.InfoHash == other.InfoHash && te.URL == other.URL && te.File == other.File && te.Message == other.Message
+}
+
+// getURLOrigin only keeps the scheme and host, private tracker URLs hold a
+// passkey.
+func getURLOrigin(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.Host == "" {
+		return ""
+	}
+	return parsedURL.Scheme + "://" + parsedURL.Host
+}
+
+// ErrorLog keeps the latest errors, most recent last.
+type ErrorLog struct {
+	mutex  sync.Mutex
+	errors []*TorrentError
+}
+
+func NewErrorLog() *ErrorLog {
+	return &ErrorLog{
+		errors: make([]*TorrentError, 0),
+	}
+}
+
+// Add stores a copy, the same error can be added to several logs.
+func (el *ErrorLog) Add(torrentError *TorrentError) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	te := *torrentError
+	te.Time = time.Now()
+	te.Count = 1
+	for i, existing := range el.errors {
+		if existing.sameAs(&te) {
+			te.Count = existing.Count + 1
+			el.errors = append(el.errors[:i], el.errors[i+1:]...)
+			break
+		}
+	}
+
+	el.errors = append(el.errors, &te)
+	if len(el.errors) > maxTorrentErrors {
+		el.errors = el.errors[len(el.errors)-maxTorrentErrors:]
+	}
+}
+
+func (el *ErrorLog) Get() []TorrentError {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	result := make([]TorrentError, 0, len(el.errors))
+	for _, torrentError := range el.errors {
+		result = append(result, *torrentError)
+	}
+	return result
+}
+
+// addTorrentError records errors of torrents being removed too, so delete
+// failures are kept until the torrent is gone.
+func (b *BitTorrent) addTorrentError(infoHash string, torrentError *TorrentError) {
+	if entry, ok := b.registry.Lookup(infoHash); ok {
+		entry.errors.Add(torrentError)
+	}
+}
+
+func (b *BitTorrent) registerErrorHandlers() {
+	b.alerts.Handle(libtorrent.Add_torrent_alertAlert_type, func(alert *Alert) {
+		if message := alert.Data.(*ErrorAlert).Error; message != "" {
+			b.onAddTorrentFailed(alert.InfoHash, message)
+		}
+	})
+	b.alerts.Handle(libtorrent.Tracker_error_alertAlert_type, func(alert *Alert) {
+		trackerErrorAlert := alert.Data.(*TrackerErrorAlert)
+		message := trackerErrorAlert.Error
+		if message == "" {
+			message = alert.Message
+		}
+		b.addTorrentError(alert.InfoHash, &TorrentError{Source: "tracker", URL: trackerErrorAlert.URL, Message: message})
+	})
+	b.alerts.Handle(libtorrent.File_error_alertAlert_type, func(alert *Alert) {
+		fileErrorAlert := alert.Data.(*FileErrorAlert)
+		log.Printf("[scrapmagnet] %s", alert.Message)
+		b.addTorrentError(alert.InfoHash, &TorrentError{Source: "file", File: fileErrorAlert.File, Message: fileErrorAlert.Error})
+	})
+	b.alerts.Handle(libtorrent.Torrent_error_alertAlert_type, func(alert *Alert) {
+		log.Printf("[scrapmagnet] %s", alert.Message)
+		b.addTorrentError(alert.InfoHash, &TorrentError{Source: "storage", Message: alert.Data.(*ErrorAlert).Error})
+	})
+	b.alerts.Handle(libtorrent.Fastresume_rejected_alertAlert_type, func(alert *Alert) {
+		b.addTorrentError(alert.InfoHash, &TorrentError{Source: "storage", Message: alert.Data.(*ErrorAlert).Error})
+	})
+	b.alerts.Handle(libtorrent.Metadata_failed_alertAlert_type, func(alert *Alert) {
+		b.addTorrentError(alert.InfoHash, &TorrentError{Source: "metadata", Message: alert.Data.(*ErrorAlert).Error})
+	})
+	b.alerts.Handle(libtorrent.Peer_error_alertAlert_type, func(alert *Alert) {
+		peerErrorAlert := alert.Data.(*PeerErrorAlert)
+		b.addTorrentError(alert.InfoHash, &TorrentError{Source: "peer", Peer: peerErrorAlert.Peer, Message: peerErrorAlert.Error})
+	})
+	b.alerts.Handle(libtorrent.Torrent_delete_failed_alertAlert_type, func(alert *Alert) {
+		torrentError := &TorrentError{Source: "delete", InfoHash: alert.InfoHash, Message: alert.Data.(*ErrorAlert).Error}
+		b.addTorrentError(alert.InfoHash, torrentError)
+		b.sessionErrors.Add(torrentError)
+	})
+
+	// Session errors aren't related to a single torrent
+	b.alerts.Handle(libtorrent.Udp_error_alertAlert_type, func(alert *Alert) {
+		b.sessionErrors.Add(&TorrentError{Source: "udp", Message: alert.Message})
+	})
+	b.alerts.Handle(libtorrent.Portmap_error_alertAlert_type, func(alert *Alert) {
+		b.sessionErrors.Add(&TorrentError{Source: "portmap", Message: alert.Message})
+	})
+	b.alerts.Handle(libtorrent.Listen_failed_alertAlert_type, func(alert *Alert) {
+		log.Printf("[scrapmagnet] %s", alert.Message)
+		b.sessionErrors.Add(&TorrentError{Source: "listen", Message: alert.Message})
+	})
+}
+
+func (b *BitTorrent) onAddTorrentFailed(infoHash string, message string) {
+	log.Printf("[scrapmagnet] Failed to add %v: %v", infoHash, message)
+
+	torrentError := &TorrentError{Time: time.Now(), Source: "add", InfoHash: infoHash, Message: message, Count: 1}
+	b.sessionErrors.Add(torrentError)
+	b.registry.OnAddFailed(infoHash, torrentError)
+	b.deleteResumeInfo(infoHash)
+	b.events.PublishInfoHash("add_failed", infoHash, torrentError)
+}
+
+func apiListErrors(w http.ResponseWriter, r *http.Request) {
+	routes.ServeJson(w, httpInstance.bitTorrent.sessionErrors.Get())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestErrorLogAdd(t *testing.T) {
+	torrentLog := NewErrorLog()
+	sessionLog := NewErrorLog()
+
+	torrentError := &TorrentError{Source: "delete", InfoHash: testInfoHash, Message: "denied"}
+	torrentLog.Add(torrentError)
+	torrentLog.Add(torrentError)
+	sessionLog.Add(torrentError)
+	torrentLog.Add(&TorrentError{Source: "tracker", InfoHash: testInfoHash, Message: "timed out"})
+
+	errors := torrentLog.Get()
+	if len(errors) != 2 || errors[0].Source != "delete" || errors[0].Count != 2 || errors[1].Count != 1 {
+		t.Errorf("Torrent errors are %+v", errors)
+	}
+	if errors := sessionLog.Get(); len(errors) != 1 || errors[0].Count != 1 {
+		t.Errorf("Session errors are %+v, the torrent log must not change them", errors)
+	}
+	if torrentError.Count != 0 || !torrentError.Time.IsZero() {
+		t.Errorf("Add() modified the added error: %+v", torrentError)
+	}
+}
+
+func TestErrorLogLimit(t *testing.T) {
+	errorLog := NewErrorLog()
+	for i := 0; i < maxTorrentErrors+5; i++ {
+		errorLog.Add(&TorrentError{Source: "peer", Message: fmt.Sprintf("error %v", i)})
+	}
+	if errors := errorLog.Get(); len(errors) != maxTorrentErrors {
+		t.Errorf("Kept %v errors, expected %v", len(errors), maxTorrentErrors)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sharkone/libtorrent-go"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	eventBufferSize     = 64
+	eventStatsInterval  = time.Second
+	eventKeepAliveDelay = 15 * time.Second
+)
+
+type Event struct {
+	Type     string      `json:"type"`
+	InfoHash string      `json:"info_hash"`
+	Name     string      `json:"name"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data,omitempty"`
+
+	// Lets handlers read the torrent while libtorrent removes it
+	handle libtorrent.Torrent_handle
+}
+
+type TorrentStats struct {
+	State        string  `json:"state_str"`
+	Paused       bool    `json:"paused"`
+	Progress     float32 `json:"progress"`
+	DownloadRate int     `json:"download_rate"`
+	UploadRate   int     `json:"upload_rate"`
+	Seeds        int     `json:"seeds"`
+	Peers        int     `json:"peers"`
+}
+
+// EventHandler receives every event synchronously, it must not block.
+type EventHandler interface {
+	HandleEvent(event *Event)
+}
+
+// EventBroker fans out torrent events to subscribers and handlers. Slow
+// subscribers miss events rather than blocking the alert pump.
+type EventBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan *Event]bool
+	handlers    []EventHandler
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{
+		subscribers: make(map[chan *Event]bool),
+	}
+}
+
+func (eb *EventBroker) Subscribe() chan *Event {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	eventChan := make(chan *Event, eventBufferSize)
+	eb.subscribers[eventChan] = true
+	return eventChan
+}
+
+func (eb *EventBroker) Unsubscribe(eventChan chan *Event) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	delete(eb.subscribers, eventChan)
+}
+
+func (eb *EventBroker) HasSubscribers() bool {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	return len(eb.subscribers) > 0
+}
+
+func (eb *EventBroker) AddHandler(handler EventHandler) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	eb.handlers = append(eb.handlers, handler)
+}
+
+func (eb *EventBroker) Publish(eventType string, handle libtorrent.Torrent_handle, data interface{}) {
+	eb.publish(eventType, bitTorrent.getTorrentInfoHash(handle), handle, data, true)
+}
+
+// PublishInfoHash is used once the torrent handle is gone.
+func (eb *EventBroker) PublishInfoHash(eventType string, infoHash string, data interface{}) {
+	eb.publish(eventType, infoHash, nil, data, true)
+}
+
+// Notify only reaches handlers, for events /events doesn't stream.
+func (eb *EventBroker) Notify(eventType string, handle libtorrent.Torrent_handle, data interface{}) {
+	eb.publish(eventType, bitTorrent.getTorrentInfoHash(handle), handle, data, false)
+}
+
+func (eb *EventBroker) publish(eventType string, infoHash string, handle libtorrent.Torrent_handle, data interface{}, toSubscribers bool) {
+	eb.mutex.Lock()
+	handlers := eb.handlers
+	hasSubscribers := toSubscribers && len(eb.subscribers) > 0
+	eb.mutex.Unlock()
+
+	if !hasSubscribers && len(handlers) == 0 {
+		return
+	}
+
+	event := &Event{
+		Type:     eventType,
+		InfoHash: infoHash,
+		Time:     time.Now(),
+		Data:     data,
+		handle:   handle,
+	}
+	if handle != nil {
+		event.Name = handle.Status().GetName()
+	}
+
+	if hasSubscribers {
+		eb.mutex.Lock()
+		for eventChan := range eb.subscribers {
+			select {
+			case eventChan <- event:
+			default:
+			}
+		}
+		eb.mutex.Unlock()
+	}
+
+	for _, handler := range handlers {
+		handler.HandleEvent(event)
+	}
+}
+
+// statsPump publishes rate and progress changes, only while someone listens.
+func (b *BitTorrent) statsPump() {
+	lastStats := make(map[string]TorrentStats)
+
+	for range time.Tick(eventStatsInterval) {
+		if !b.events.HasSubscribers() {
+			lastStats = make(map[string]TorrentStats)
+			continue
+		}
+
+		currentStats := make(map[string]TorrentStats)
+		handles := b.session.Get_torrents()
+		for i := 0; i < int(handles.Size()); i++ {
+			handle := handles.Get(i)
+			infoHash := b.getTorrentInfoHash(handle)
+			if !b.registry.IsActive(infoHash) {
+				continue
+			}
+
+			torrentStatus := handle.Status()
+			stats := TorrentStats{
+				State:        getTorrentStateStr(torrentStatus.GetState()),
+				Paused:       torrentStatus.GetPaused(),
+				Progress:     torrentStatus.GetProgress(),
+				DownloadRate: torrentStatus.GetDownload_rate() / 1024,
+				UploadRate:   torrentStatus.GetUpload_rate() / 1024,
+				Seeds:        torrentStatus.GetNum_seeds(),
+				Peers:        torrentStatus.GetNum_peers(),
+			}
+			currentStats[infoHash] = stats
+
+			if previous, ok := lastStats[infoHash]; !ok || previous != stats {
+				b.events.Publish("stats", handle, stats)
+			}
+		}
+		lastStats = currentStats
+	}
+}
+
+func getEventFilter(r *http.Request) map[string]bool {
+	result := make(map[string]bool)
+	for _, infoHashes := range r.URL.Query()["info_hash"] {
+		for _, infoHash := range strings.Split(infoHashes, ",") {
+			if infoHash != "" {
+				result[strings.ToUpper(infoHash)] = true
+			}
+		}
+	}
+	return result
+}
+
+func acceptEvent(filter map[string]bool, event *Event) bool {
+	return len(filter) == 0 || filter[event.InfoHash]
+}
+
+func events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := getEventFilter(r)
+	eventChan := httpInstance.bitTorrent.events.Subscribe()
+	defer httpInstance.bitTorrent.events.Unsubscribe(eventChan)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(eventKeepAliveDelay):
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-eventChan:
+			if !acceptEvent(filter, event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+func eventsWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	filter := getEventFilter(ws.Request())
+	eventChan := httpInstance.bitTorrent.events.Subscribe()
+	defer httpInstance.bitTorrent.events.Unsubscribe(eventChan)
+
+	// Clients never send anything, a read only returns once they are gone
+	closedChan := make(chan bool)
+	go func() {
+		var message string
+		for websocket.Message.Receive(ws, &message) == nil {
+		}
+		close(closedChan)
+	}()
+
+	for {
+		select {
+		case <-closedChan:
+			return
+		case event := <-eventChan:
+			if !acceptEvent(filter, event) {
+				continue
+			}
+			if err := websocket.JSON.Send(ws, event); err != nil {
+				return
+			}
+		}
+	}
+}
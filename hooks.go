@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	hookQueueSize    = 64
+	hookMaxLogOutput = 64 * 1024
+)
+
+type hookPayload struct {
+	Event   string       `json:"event"`
+	Time    time.Time    `json:"time"`
+	Torrent *TorrentInfo `json:"torrent"`
+}
+
+type hookRun struct {
+	flagName string
+	command  string
+	env      []string
+	stdin    []byte
+}
+
+// HookRunner executes the --on-* commands from a bounded pool of workers, so
+// neither the alert pump nor other hooks wait on a slow command.
+type HookRunner struct {
+	commands map[string]string
+	queue    chan *hookRun
+}
+
+var hooks *HookRunner
+
+func NewHookRunner() *HookRunner {
+	commands := make(map[string]string)
+	for eventType, command := range map[string]string{
+		"added":             settings.onAdded,
+		"metadata_received": settings.onMetadata,
+		"finished":          settings.onFinished,
+		"removed":           settings.onRemoved,
+	} {
+		if command != "" {
+			commands[eventType] = command
+		}
+	}
+
+	return &HookRunner{
+		commands: commands,
+		queue:    make(chan *hookRun, hookQueueSize),
+	}
+}
+
+func (hr *HookRunner) Start() {
+	concurrency := settings.hookConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for run := range hr.queue {
+				hr.run(run)
+			}
+		}()
+	}
+}
+
+func getHookFlagName(eventType string) string {
+	if eventType == "metadata_received" {
+		return "on-metadata"
+	}
+	return "on-" + eventType
+}
+
+// HandleEvent snapshots the torrent while the alert pump still knows it.
+func (hr *HookRunner) HandleEvent(event *Event) {
+	command, ok := hr.commands[event.Type]
+	if !ok {
+		return
+	}
+
+	torrentInfo, ok := event.Data.(*TorrentInfo)
+	if !ok || torrentInfo == nil {
+		if event.handle != nil && event.handle.Is_valid() {
+			torrentInfo = NewTorrentInfo(event.handle)
+		} else if torrentInfo = bitTorrent.GetTorrentInfo(event.InfoHash); torrentInfo == nil {
+			torrentInfo = &TorrentInfo{InfoHash: event.InfoHash, Name: event.Name}
+		}
+	}
+
+	stdin, err := json.Marshal(&hookPayload{Event: event.Type, Time: event.Time, Torrent: torrentInfo})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	filePaths := make([]string, 0, len(torrentInfo.Files))
+	for _, torrentFileInfo := range torrentInfo.Files {
+		filePaths = append(filePaths, torrentFileInfo.Path)
+	}
+
+	run := &hookRun{
+		flagName: getHookFlagName(event.Type),
+		command:  command,
+		env: append(os.Environ(),
+			"SCRAPMAGNET_EVENT="+event.Type,
+			"SCRAPMAGNET_INFO_HASH="+torrentInfo.InfoHash,
+			"SCRAPMAGNET_NAME="+torrentInfo.Name,
+			"SCRAPMAGNET_SAVE_PATH="+torrentInfo.DownloadDir,
+			"SCRAPMAGNET_FILES="+strings.Join(filePaths, "\n"),
+			fmt.Sprintf("SCRAPMAGNET_FILE_COUNT=%d", len(filePaths)),
+		),
+		stdin: stdin,
+	}
+
+	select {
+	case hr.queue <- run:
+	default:
+		log.Printf("[scrapmagnet] Hook %v queue full, skipping %v", run.flagName, torrentInfo.Name)
+	}
+}
+
+func (hr *HookRunner) run(run *hookRun) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.hookTimeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, run.command)
+	cmd.Env = run.env
+	cmd.Stdin = bytes.NewReader(run.stdin)
+
+	startTime := time.Now()
+	output, err := cmd.CombinedOutput()
+	if len(output) > hookMaxLogOutput {
+		output = output[len(output)-hookMaxLogOutput:]
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		log.Printf("[scrapmagnet] Hook %v: %s", run.flagName, scanner.Text())
+	}
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		log.Printf("[scrapmagnet] Hook %v killed after %v", run.flagName, time.Duration(settings.hookTimeout)*time.Second)
+	case err != nil:
+		log.Printf("[scrapmagnet] Hook %v failed: %v", run.flagName, err)
+	default:
+		log.Printf("[scrapmagnet] Hook %v done in %v", run.flagName, time.Since(startTime))
+	}
+}
@@ -1,18 +1,39 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
-	"regexp"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/drone/routes"
 	"github.com/mitchellh/go-ps"
 	"github.com/stretchr/graceful"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	maxTorrentFileSize = 10 * 1024 * 1024
+	notReadyRetryDelay = 2 * time.Second
+	readyPollInterval  = 500 * time.Millisecond
+	maxReadyWait       = 2 * time.Minute
+	notReadyRedirect   = "redirect"
+	notReadyAccepted   = "accepted"
+
+	torrentFetchTimeout  = 30 * time.Second
+	torrentURLCacheTTL   = 10 * time.Minute
+	torrentURLCacheLimit = 32
 )
 
 var httpInstance *Http = nil
@@ -30,20 +51,67 @@ func NewHttp(bitTorrent *BitTorrent) *Http {
 	mux := routes.New()
 	mux.Get("/", index)
 	mux.Get("/video", video)
-	mux.Get("/shutdown", shutdown)
+	mux.Get("/ready", ready)
+	mux.Get("/subtitles", subtitles)
+	mux.Post("/torrents", addTorrent)
+	mux.Get("/metrics", metricsHandler)
+	mux.Post("/shutdown", shutdown)
+	addApiRoutes(mux)
+	mux.Filter(authFilter)
+
+	// The routes response writer hides http.Flusher and http.Hijacker, which
+	// streams need, so they are served in front of it
+	streamMux := http.NewServeMux()
+	streamMux.HandleFunc("/events", streamHandler(events))
+	streamMux.HandleFunc("/events/ws", streamHandler(websocket.Handler(eventsWebSocket).ServeHTTP))
+	streamMux.HandleFunc("/debug/alerts", streamHandler(debugAlerts))
+	streamMux.Handle("/", mux)
 
 	return &Http{
 		bitTorrent: bitTorrent,
 		server: &graceful.Server{
 			Timeout: 500 * time.Millisecond,
 			Server: &http.Server{
-				Addr:    fmt.Sprintf("%v:%v", "0.0.0.0", settings.httpPort),
-				Handler: mux,
+				Handler: streamMux,
 			},
 		},
 	}
 }
 
+// filterWriter tells whether a filter answered the request.
+type filterWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (fw *filterWriter) WriteHeader(code int) {
+	fw.written = true
+	fw.ResponseWriter.WriteHeader(code)
+}
+
+func (fw *filterWriter) Write(data []byte) (int, error) {
+	fw.written = true
+	return fw.ResponseWriter.Write(data)
+}
+
+// streamHandler serves GET requests with the server response writer, once
+// authFilter let them through.
+func streamHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filtered := &filterWriter{ResponseWriter: w}
+		if authFilter(filtered, r); filtered.written {
+			return
+		}
+		handler(w, r)
+	}
+}
+
 func (h *Http) Start() {
 	// Parent process monitoring
 	if settings.parentPID != -1 {
@@ -61,7 +129,13 @@ func (h *Http) Start() {
 	}
 
 	httpInstance = h
-	err := h.server.ListenAndServe()
+	listener, err := listenHttp()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	err = h.server.Serve(listener)
 	if err != nil {
 		log.Print(err)
 	}
@@ -75,54 +149,136 @@ func index(w http.ResponseWriter, r *http.Request) {
 }
 
 func video(w http.ResponseWriter, r *http.Request) {
-	magnetLink := getQueryParam(r, "magnet_link", "")
-	downloadDir := getQueryParam(r, "download_dir", ".")
+	startedAt := time.Now()
 	preview := getQueryParam(r, "preview", "0")
-	lookAhead, _ := strconv.ParseFloat(getQueryParam(r, "look_ahead", "0.005"), 32)
-	mixpanelData := getQueryParam(r, "mixpanel_data", "")
 
-	if magnetLink != "" {
-		if regExpMatch := regexp.MustCompile(`xt=urn:btih:([a-zA-Z0-9]+)`).FindStringSubmatch(magnetLink); len(regExpMatch) == 2 {
-			infoHash := strings.ToUpper(regExpMatch[1])
+	notReadyMode := getQueryParam(r, "not_ready", settings.videoNotReadyMode)
+	if notReadyMode != notReadyRedirect && notReadyMode != notReadyAccepted {
+		http.Error(w, "Invalid not_ready mode", http.StatusBadRequest)
+		return
+	}
 
-			httpInstance.bitTorrent.AddTorrent(magnetLink, downloadDir, infoHash, float32(lookAhead), mixpanelData)
+	fileSelector, err := getFileSelector(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			if torrentInfo := httpInstance.bitTorrent.GetTorrentInfo(infoHash); torrentInfo != nil {
-				httpInstance.bitTorrent.AddConnection(infoHash)
-				defer httpInstance.bitTorrent.RemoveConnection(infoHash)
+	infoHash, ok := getRequestInfoHash(w, r, fileSelector)
+	if !ok {
+		return
+	}
+
+	if torrentInfo := httpInstance.bitTorrent.GetTorrentInfo(infoHash); torrentInfo != nil {
+		httpInstance.bitTorrent.AddConnection(infoHash)
+		defer httpInstance.bitTorrent.RemoveConnection(infoHash)
 
-				if torrentFileInfo := torrentInfo.GetBiggestTorrentFileInfo(); torrentFileInfo != nil {
-					if preview == "0" {
-						if torrentFileInfo.Open(torrentInfo.DownloadDir) {
-							defer torrentFileInfo.Close()
-							http.ServeContent(w, r, torrentFileInfo.Path, time.Time{}, torrentFileInfo)
-						} else {
-							http.Error(w, "Failed to open file", http.StatusInternalServerError)
-						}
-					} else {
-						videoReady(w, torrentFileInfo.IsVideoReady())
-					}
-				} else {
-					// Video not ready yet
-					if preview == "0" {
-						redirect(w, r)
-					} else {
-						videoReady(w, false)
-					}
+		torrentFileInfo, ok := selectTorrentFile(w, torrentInfo, fileSelector)
+		if !ok {
+			return
+		}
+
+		if torrentFileInfo != nil {
+			if preview == "0" {
+				if err := torrentFileInfo.Open(r.Context(), torrentInfo.DownloadDir); err == nil {
+					defer torrentFileInfo.Close()
+					torrentFileInfo.StartStream(startedAt)
+					defer torrentFileInfo.StopStream()
+					http.ServeContent(w, r, torrentFileInfo.Path, time.Time{}, torrentFileInfo)
+				} else if err == errOutsideStorageRoot {
+					http.Error(w, err.Error(), http.StatusForbidden)
+				} else if err == context.DeadlineExceeded {
+					http.Error(w, "Timed out waiting for file", http.StatusGatewayTimeout)
+				} else if err != context.Canceled {
+					http.Error(w, "Failed to open file", http.StatusInternalServerError)
 				}
 			} else {
-				// Torrent not ready yet
-				if preview == "0" {
-					redirect(w, r)
-				} else {
-					videoReady(w, false)
+				isVideoReady := torrentFileInfo.IsVideoReady()
+				if !isVideoReady && !fileSelector.IsDefault() {
+					torrentFileInfo.SetInitialPriority()
 				}
+				videoReady(w, NewVideoReadiness(infoHash, torrentInfo, torrentFileInfo, isVideoReady))
 			}
 		} else {
-			http.Error(w, "Invalid Magnet link", http.StatusBadRequest)
+			// Video not ready yet
+			notReady(w, r, preview, notReadyMode, NewVideoReadiness(infoHash, torrentInfo, nil, false))
 		}
 	} else {
-		http.Error(w, "Missing Magnet link", http.StatusBadRequest)
+		// Torrent not ready yet
+		notReady(w, r, preview, notReadyMode, NewVideoReadiness(infoHash, nil, nil, false))
+	}
+}
+
+// ready long-polls until the selected video is ready or the wait expires.
+func ready(w http.ResponseWriter, r *http.Request) {
+	wait, err := parseWait(getQueryParam(r, "wait", "0"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileSelector, err := getFileSelector(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	infoHash, ok := getRequestInfoHash(w, r, fileSelector)
+	if !ok {
+		return
+	}
+
+	timeout := time.After(wait)
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	connected := false
+	for {
+		readiness := NewVideoReadiness(infoHash, nil, nil, false)
+
+		if torrentInfo := httpInstance.bitTorrent.GetTorrentInfo(infoHash); torrentInfo != nil {
+			// Keep the torrent from being paused while waiting
+			if !connected {
+				httpInstance.bitTorrent.AddConnection(infoHash)
+				defer httpInstance.bitTorrent.RemoveConnection(infoHash)
+				connected = true
+			}
+
+			torrentFileInfo, ok := selectTorrentFile(w, torrentInfo, fileSelector)
+			if !ok {
+				return
+			}
+			readiness = NewVideoReadiness(infoHash, torrentInfo, torrentFileInfo, torrentFileInfo != nil && torrentFileInfo.IsVideoReady())
+		}
+
+		if readiness.VideoReady {
+			videoReady(w, readiness)
+			return
+		} else if torrentError := httpInstance.bitTorrent.registry.GetAddFailure(infoHash); torrentError != nil {
+			addFailed(w, infoHash, torrentError)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			videoReady(w, readiness)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func addTorrent(w http.ResponseWriter, r *http.Request) {
+	fileSelector, err := getFileSelector(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if infoHash, ok := addTorrentFromRequest(w, r, fileSelector, true); ok {
+		routes.ServeJson(w, map[string]interface{}{"info_hash": infoHash})
 	}
 }
 
@@ -139,11 +295,323 @@ func getQueryParam(r *http.Request, paramName string, defaultValue string) (resu
 	return result
 }
 
+func getFileSelector(r *http.Request) (*TorrentFileSelector, error) {
+	fileIndex := -1
+	if fileIndexStr := getQueryParam(r, "file_index", ""); fileIndexStr != "" {
+		var err error
+		if fileIndex, err = strconv.Atoi(fileIndexStr); err != nil || fileIndex < 0 {
+			return nil, errors.New("Invalid file index")
+		}
+	}
+	return NewTorrentFileSelector(fileIndex, getQueryParam(r, "file_path", ""), getQueryParam(r, "file_match", "")), nil
+}
+
+// addTorrentFromRequest adds the torrent given by the magnet_link, torrent_url
+// or torrent_path parameters, or by an uploaded .torrent file when readBody is
+// set. Errors are reported to the client, in which case ok is false.
+func addTorrentFromRequest(w http.ResponseWriter, r *http.Request, fileSelector *TorrentFileSelector, readBody bool) (infoHash string, ok bool) {
+	magnetLink := getQueryParam(r, "magnet_link", "")
+	lookAhead, _ := strconv.ParseFloat(getQueryParam(r, "look_ahead", "0.005"), 32)
+	mixpanelData := getQueryParam(r, "mixpanel_data", "")
+
+	downloadDir, err := resolveStoragePath(getQueryParam(r, "download_dir", "."))
+	if err != nil {
+		http.Error(w, "Invalid download directory: "+err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+
+	if magnetLink != "" {
+		magnet, err := ParseMagnet(magnetLink)
+		if err != nil {
+			http.Error(w, "Invalid Magnet link: "+err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+
+		if err := httpInstance.bitTorrent.AddTorrent(magnet, downloadDir, float32(lookAhead), fileSelector, mixpanelData); err != nil {
+			addFailed(w, magnet.InfoHash, err)
+			return "", false
+		}
+		return magnet.InfoHash, true
+	}
+
+	torrentData, status, err := readTorrentFile(r, readBody)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return "", false
+	} else if torrentData == nil {
+		http.Error(w, "Missing Magnet link or torrent", http.StatusBadRequest)
+		return "", false
+	}
+
+	if infoHash, err = httpInstance.bitTorrent.AddTorrentFile(torrentData, downloadDir, float32(lookAhead), fileSelector, mixpanelData); err != nil {
+		if _, ok := err.(*TorrentError); ok {
+			addFailed(w, infoHash, err)
+		} else {
+			http.Error(w, "Invalid torrent: "+err.Error(), http.StatusBadRequest)
+		}
+		return "", false
+	}
+	return infoHash, true
+}
+
+var errTorrentPathDisabled = errors.New("torrent_path requires a storage root")
+
+// readTorrentFile returns nil data when the request carries no torrent.
+func readTorrentFile(r *http.Request, readBody bool) ([]byte, int, error) {
+	if torrentURL := getQueryParam(r, "torrent_url", ""); torrentURL != "" {
+		return torrentURLs.Fetch(torrentURL)
+	}
+
+	// Without a storage root any file readable by the process could be probed
+	if torrentPath := getQueryParam(r, "torrent_path", ""); torrentPath != "" {
+		if settings.storageRoot == "" {
+			return nil, http.StatusForbidden, errTorrentPathDisabled
+		}
+
+		torrentPath, err := resolveStoragePath(torrentPath)
+		if err == nil {
+			err = checkStoragePath(torrentPath)
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		file, err := os.Open(torrentPath)
+		if err != nil {
+			return nil, http.StatusNotFound, err
+		}
+		defer file.Close()
+		return readTorrentData(file)
+	}
+
+	if !readBody {
+		return nil, http.StatusOK, nil
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("torrent")
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		defer file.Close()
+		return readTorrentData(file)
+	}
+
+	data, status, err := readTorrentData(r.Body)
+	if err == nil && len(data) == 0 {
+		return nil, http.StatusOK, nil
+	}
+	return data, status, err
+}
+
+type cachedTorrent struct {
+	data      []byte
+	fetchedAt time.Time
+}
+
+// TorrentURLCache fetches torrent_url parameters, players retrying /video
+// while the torrent is added don't fetch it again.
+type TorrentURLCache struct {
+	mutex    sync.Mutex
+	client   *http.Client
+	torrents map[string]*cachedTorrent
+}
+
+var torrentURLs = NewTorrentURLCache()
+
+func NewTorrentURLCache() *TorrentURLCache {
+	return &TorrentURLCache{
+		client:   &http.Client{Timeout: torrentFetchTimeout},
+		torrents: make(map[string]*cachedTorrent),
+	}
+}
+
+func (tuc *TorrentURLCache) get(torrentURL string) []byte {
+	tuc.mutex.Lock()
+	defer tuc.mutex.Unlock()
+
+	if torrent, ok := tuc.torrents[torrentURL]; ok {
+		if time.Since(torrent.fetchedAt) < torrentURLCacheTTL {
+			return torrent.data
+		}
+		delete(tuc.torrents, torrentURL)
+	}
+	return nil
+}
+
+// put drops expired torrents, then the oldest one when the cache is full.
+func (tuc *TorrentURLCache) put(torrentURL string, data []byte) {
+	tuc.mutex.Lock()
+	defer tuc.mutex.Unlock()
+
+	oldestURL := ""
+	for cachedURL, torrent := range tuc.torrents {
+		if time.Since(torrent.fetchedAt) >= torrentURLCacheTTL {
+			delete(tuc.torrents, cachedURL)
+		} else if oldestURL == "" || torrent.fetchedAt.Before(tuc.torrents[oldestURL].fetchedAt) {
+			oldestURL = cachedURL
+		}
+	}
+	if len(tuc.torrents) >= torrentURLCacheLimit && oldestURL != "" {
+		delete(tuc.torrents, oldestURL)
+	}
+	tuc.torrents[torrentURL] = &cachedTorrent{data: data, fetchedAt: time.Now()}
+}
+
+// Fetch only accepts http and https URLs, failures are not cached.
+func (tuc *TorrentURLCache) Fetch(torrentURL string) ([]byte, int, error) {
+	parsedURL, err := url.Parse(torrentURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return nil, http.StatusBadRequest, errors.New("Torrent URL must be an absolute http or https URL")
+	}
+
+	if data := tuc.get(torrentURL); data != nil {
+		return data, http.StatusOK, nil
+	}
+
+	resp, err := tuc.client.Get(torrentURL)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, http.StatusBadGateway, fmt.Errorf("Failed to fetch torrent: %v", resp.Status)
+	}
+
+	data, status, err := readTorrentData(resp.Body)
+	if err == nil {
+		tuc.put(torrentURL, data)
+	}
+	return data, status, err
+}
+
+func readTorrentData(reader io.Reader) ([]byte, int, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxTorrentFileSize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(data) > maxTorrentFileSize {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("Torrent file too large")
+	}
+	return data, http.StatusOK, nil
+}
+
+// getRequestInfoHash returns the info_hash parameter of an already added
+// torrent, or adds the torrent described by the request.
+func getRequestInfoHash(w http.ResponseWriter, r *http.Request, fileSelector *TorrentFileSelector) (string, bool) {
+	infoHash := strings.ToUpper(getQueryParam(r, "info_hash", ""))
+	if infoHash == "" {
+		return addTorrentFromRequest(w, r, fileSelector, false)
+	}
+
+	if !httpInstance.bitTorrent.HasTorrent(infoHash) {
+		if torrentError := httpInstance.bitTorrent.registry.GetAddFailure(infoHash); torrentError != nil {
+			addFailed(w, infoHash, torrentError)
+		} else {
+			http.Error(w, "Unknown torrent", http.StatusNotFound)
+		}
+		return "", false
+	}
+	httpInstance.bitTorrent.updateFileSelector(infoHash, fileSelector)
+	return infoHash, true
+}
+
+// selectTorrentFile returns a nil file without error while metadata is missing.
+func selectTorrentFile(w http.ResponseWriter, torrentInfo *TorrentInfo, fileSelector *TorrentFileSelector) (*TorrentFileInfo, bool) {
+	torrentFileInfo, err := fileSelector.Select(torrentInfo)
+	if err == errTorrentFileNotFound && len(torrentInfo.Files) > 0 {
+		fileNotFound(w, torrentInfo)
+		return nil, false
+	} else if err != nil && err != errTorrentFileNotFound {
+		http.Error(w, "Invalid file match: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return torrentFileInfo, true
+}
+
+// parseWait accepts Go durations (ex: 30s) as well as plain seconds.
+func parseWait(value string) (time.Duration, error) {
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, errors.New("Invalid wait duration")
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	if wait < 0 {
+		return 0, errors.New("Invalid wait duration")
+	} else if wait > maxReadyWait {
+		wait = maxReadyWait
+	}
+	return wait, nil
+}
+
+func notReady(w http.ResponseWriter, r *http.Request, preview string, notReadyMode string, readiness *VideoReadiness) {
+	if preview != "0" {
+		videoReady(w, readiness)
+	} else if notReadyMode == notReadyAccepted {
+		w.Header().Set("Retry-After", strconv.Itoa(int(notReadyRetryDelay/time.Second)))
+		serveJsonStatus(w, http.StatusAccepted, readiness)
+	} else {
+		redirect(w, r)
+	}
+}
+
 func redirect(w http.ResponseWriter, r *http.Request) {
-	time.Sleep(2 * time.Second)
+	time.Sleep(notReadyRetryDelay)
 	http.Redirect(w, r, r.URL.String(), http.StatusTemporaryRedirect)
 }
 
-func videoReady(w http.ResponseWriter, videoReady bool) {
-	routes.ServeJson(w, map[string]interface{}{"video_ready": videoReady})
+type VideoReadiness struct {
+	VideoReady bool    `json:"video_ready"`
+	InfoHash   string  `json:"info_hash"`
+	State      string  `json:"state_str"`
+	Progress   float32 `json:"progress"`
+	File       string  `json:"file,omitempty"`
+	FileIndex  int     `json:"file_index"`
+}
+
+func NewVideoReadiness(infoHash string, torrentInfo *TorrentInfo, torrentFileInfo *TorrentFileInfo, videoReady bool) *VideoReadiness {
+	result := &VideoReadiness{
+		VideoReady: videoReady,
+		InfoHash:   infoHash,
+		State:      "Adding",
+		FileIndex:  -1,
+	}
+	if torrentInfo != nil {
+		result.State = torrentInfo.StateStr
+		result.Progress = torrentInfo.Progress
+	}
+	if torrentFileInfo != nil {
+		result.File = torrentFileInfo.Path
+		result.FileIndex = torrentFileInfo.Index
+	}
+	return result
+}
+
+func videoReady(w http.ResponseWriter, readiness *VideoReadiness) {
+	routes.ServeJson(w, readiness)
+}
+
+// addFailed tells clients retrying is pointless, libtorrent rejected the
+// torrent.
+func addFailed(w http.ResponseWriter, infoHash string, err error) {
+	serveJsonStatus(w, http.StatusUnprocessableEntity, map[string]interface{}{"info_hash": infoHash, "error": err})
+}
+
+func fileNotFound(w http.ResponseWriter, torrentInfo *TorrentInfo) {
+	files := make([]map[string]interface{}, 0, len(torrentInfo.Files))
+	for _, torrentFileInfo := range torrentInfo.Files {
+		files = append(files, map[string]interface{}{"index": torrentFileInfo.Index, "path": torrentFileInfo.Path, "size": torrentFileInfo.Size})
+	}
+	serveJsonStatus(w, http.StatusNotFound, map[string]interface{}{"error": errTorrentFileNotFound.Error(), "files": files})
+}
+
+func serveJsonStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	unixSocketPrefix       = "unix:"
+	selfSignedCertFile     = "tls-cert.pem"
+	selfSignedKeyFile      = "tls-key.pem"
+	selfSignedCertValidity = 10 * 365 * 24 * time.Hour
+)
+
+var errListenerClosed = errors.New("use of closed network connection")
+
+// multiListener accepts connections from several listeners, so a single
+// graceful server can serve all of them. A listener failing for good is
+// dropped, the server only stops once all of them failed.
+type multiListener struct {
+	listeners []net.Listener
+	connChan  chan net.Conn
+	errChan   chan error
+	closeChan chan bool
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	alive     int
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	result := &multiListener{
+		listeners: listeners,
+		connChan:  make(chan net.Conn),
+		errChan:   make(chan error),
+		closeChan: make(chan bool),
+		alive:     len(listeners),
+	}
+
+	for _, listener := range listeners {
+		go result.serve(listener)
+	}
+
+	return result
+}
+
+func (ml *multiListener) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ml.closeChan:
+				return
+			default:
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				select {
+				case ml.errChan <- err:
+				case <-ml.closeChan:
+					return
+				}
+				continue
+			}
+
+			ml.mutex.Lock()
+			ml.alive--
+			alive := ml.alive
+			ml.mutex.Unlock()
+
+			if alive > 0 {
+				log.Printf("[scrapmagnet] Stopped listening on %v: %v", listener.Addr(), err)
+				listener.Close()
+				return
+			}
+			select {
+			case ml.errChan <- err:
+			case <-ml.closeChan:
+			}
+			return
+		}
+
+		select {
+		case ml.connChan <- conn:
+		case <-ml.closeChan:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.connChan:
+		return conn, nil
+	case err := <-ml.errChan:
+		return nil, err
+	case <-ml.closeChan:
+		return nil, &net.OpError{Op: "accept", Net: "multi", Err: errListenerClosed}
+	}
+}
+
+func (ml *multiListener) Close() (err error) {
+	ml.closeOnce.Do(func() {
+		close(ml.closeChan)
+		for _, listener := range ml.listeners {
+			if closeErr := listener.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
+// getHttpBinds defaults to all interfaces on the HTTP port. Addresses
+// without a port (ex: 127.0.0.1, ::1) use the HTTP port.
+func getHttpBinds() (result []string) {
+	for _, bind := range strings.Split(settings.httpBind, ",") {
+		if bind = strings.TrimSpace(bind); bind == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(bind, unixSocketPrefix) {
+			if _, _, err := net.SplitHostPort(bind); err != nil {
+				bind = net.JoinHostPort(strings.Trim(bind, "[]"), strconv.Itoa(settings.httpPort))
+			}
+		}
+		result = append(result, bind)
+	}
+
+	if len(result) == 0 {
+		result = append(result, net.JoinHostPort("0.0.0.0", strconv.Itoa(settings.httpPort)))
+	}
+	return result
+}
+
+func listenHttp() (net.Listener, error) {
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, 0)
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	for _, bind := range getHttpBinds() {
+		if strings.HasPrefix(bind, unixSocketPrefix) {
+			socketPath := strings.TrimPrefix(bind, unixSocketPrefix)
+
+			// Remove a stale socket left by a crash
+			if fileInfo, err := os.Lstat(socketPath); err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+				os.Remove(socketPath)
+			}
+
+			listener, err := net.Listen("unix", socketPath)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			listeners = append(listeners, listener)
+		} else {
+			listener, err := net.Listen("tcp", bind)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			if tlsConfig != nil {
+				listener = tls.NewListener(listener, tlsConfig)
+			}
+			listeners = append(listeners, listener)
+		}
+
+		log.Printf("[scrapmagnet] Listening on %v", bind)
+	}
+
+	return newMultiListener(listeners), nil
+}
+
+// getTLSConfig returns nil when TLS is disabled.
+func getTLSConfig() (*tls.Config, error) {
+	var certificate tls.Certificate
+	var err error
+
+	switch {
+	case settings.tlsCert != "" || settings.tlsKey != "":
+		certificate, err = tls.LoadX509KeyPair(settings.tlsCert, settings.tlsKey)
+	case settings.tlsSelfSigned:
+		certificate, err = getSelfSignedCertificate()
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}, nil
+}
+
+// getSelfSignedCertificate reuses the certificate persisted in the state
+// directory, so clients only have to trust it once.
+func getSelfSignedCertificate() (tls.Certificate, error) {
+	certPath := filepath.Join(settings.stateDir, selfSignedCertFile)
+	keyPath := filepath.Join(settings.stateDir, selfSignedKeyFile)
+
+	if settings.stateDir != "" {
+		if certificate, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+			return certificate, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if settings.stateDir != "" {
+		if err := os.MkdirAll(settings.stateDir, 0755); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Printf("[scrapmagnet] Generated self-signed certificate %v", certPath)
+	} else {
+		log.Print("[scrapmagnet] No state directory, self-signed certificate will change on restart")
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func generateSelfSignedCertificate() (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"scrapmagnet"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	for _, bind := range getHttpBinds() {
+		if host, _, err := net.SplitHostPort(bind); err == nil {
+			if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiListenerDropsFailedListener(t *testing.T) {
+	listeners := make([]net.Listener, 0)
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+	}
+	multiListener := newMultiListener(listeners)
+	defer multiListener.Close()
+
+	type acceptResult struct {
+		conn net.Conn
+		err  error
+	}
+	accept := func() chan acceptResult {
+		result := make(chan acceptResult, 1)
+		go func() {
+			conn, err := multiListener.Accept()
+			result <- acceptResult{conn, err}
+		}()
+		return result
+	}
+
+	// Ex: the socket of a bind was removed
+	listeners[0].Close()
+	pending := accept()
+	conn, err := net.Dial("tcp", listeners[1].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case result := <-pending:
+		if result.err != nil {
+			t.Fatalf("Accept() = %v, expected the other listener to keep serving", result.err)
+		}
+		result.conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept() timed out")
+	}
+
+	listeners[1].Close()
+	select {
+	case result := <-accept():
+		if result.err == nil {
+			t.Error("Accept() succeeded once all listeners failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept() timed out once all listeners failed")
+	}
+}
+
+func TestMultiListenerClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiListener := newMultiListener([]net.Listener{listener})
+	multiListener.Close()
+
+	if _, err := multiListener.Accept(); err == nil {
+		t.Error("Accept() succeeded after Close()")
+	}
+}
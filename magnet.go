@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sharkone/libtorrent-go"
+)
+
+const (
+	magnetPrefix = "magnet:?"
+
+	// Ranges are expanded, so indices are bounded
+	maxSelectOnlyIndex = 100000
+)
+
+// Magnet is a parsed magnet link, see BEP 9 and BEP 53.
+type Magnet struct {
+	Link        string   `json:"link"`
+	InfoHash    string   `json:"info_hash"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Trackers    []string `json:"trackers,omitempty"`
+	WebSeeds    []string `json:"web_seeds,omitempty"`
+	ExactLength int64    `json:"exact_length,omitempty"`
+	Peers       []string `json:"peers,omitempty"`
+	SelectOnly  []int    `json:"select_only,omitempty"`
+}
+
+// ParseMagnet accepts hex and base32 btih, the info hash is returned in the
+// format of getTorrentInfoHash.
+func ParseMagnet(link string) (*Magnet, error) {
+	if len(link) < len(magnetPrefix) || !strings.EqualFold(link[:len(magnetPrefix)], magnetPrefix) {
+		return nil, fmt.Errorf("Magnet link must start with %q", magnetPrefix)
+	}
+
+	values, err := url.ParseQuery(link[len(magnetPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid magnet link query: %v", err)
+	}
+
+	// Sorted so numbered keys keep their order
+	keys := make([]magnetKey, 0, len(values))
+	for key := range values {
+		keys = append(keys, parseMagnetKey(key))
+	}
+	sort.Sort(byMagnetKey(keys))
+
+	magnet := &Magnet{Link: link}
+	for _, key := range keys {
+		for _, value := range values[key.key] {
+			if err := magnet.parseParam(key.name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if magnet.InfoHash == "" {
+		return nil, fmt.Errorf("Magnet link has no xt=urn:btih: info hash")
+	}
+	return magnet, nil
+}
+
+// magnetKey is a query key, multiple values may be numbered, ex: tr.1, tr.2.
+type magnetKey struct {
+	key   string
+	name  string
+	index int
+}
+
+func parseMagnetKey(key string) magnetKey {
+	if dot := strings.LastIndex(key, "."); dot > 0 {
+		if index, err := strconv.Atoi(key[dot+1:]); err == nil {
+			return magnetKey{key: key, name: key[:dot], index: index}
+		}
+	}
+	return magnetKey{key: key, name: key, index: -1}
+}
+
+// parseParam only fails on malformed values libtorrent can't do without,
+// unsupported trackers and web seeds are skipped like libtorrent does.
+func (m *Magnet) parseParam(name string, value string) error {
+	switch name {
+	case "xt":
+		// Other hashes, ex: urn:btmh: for BitTorrent v2, are ignored
+		if len(value) < 9 || !strings.EqualFold(value[:9], "urn:btih:") {
+			return nil
+		}
+		infoHash, err := parseBtih(value[9:])
+		if err != nil {
+			return err
+		}
+		if m.InfoHash != "" && m.InfoHash != infoHash {
+			return fmt.Errorf("Magnet link has different info hashes %v and %v", m.InfoHash, infoHash)
+		}
+		m.InfoHash = infoHash
+	case "dn":
+		m.DisplayName = value
+	case "tr":
+		if err := validateMagnetURL(value, "http", "https", "udp"); err != nil {
+			log.Printf("[scrapmagnet] Ignoring tracker %v: %v", value, err)
+			return nil
+		}
+		m.Trackers = appendUnique(m.Trackers, value)
+	case "ws":
+		if err := validateMagnetURL(value, "http", "https"); err != nil {
+			log.Printf("[scrapmagnet] Ignoring web seed %v: %v", value, err)
+			return nil
+		}
+		m.WebSeeds = appendUnique(m.WebSeeds, value)
+	case "xl":
+		exactLength, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || exactLength <= 0 {
+			return fmt.Errorf("Invalid exact length %q: must be a positive number of bytes", value)
+		}
+		m.ExactLength = exactLength
+	case "x.pe":
+		if err := validatePeerAddress(value); err != nil {
+			return fmt.Errorf("Invalid peer %q: %v", value, err)
+		}
+		m.Peers = appendUnique(m.Peers, value)
+	case "so":
+		selectOnly, err := parseSelectOnly(value)
+		if err != nil {
+			return fmt.Errorf("Invalid file selection %q: %v", value, err)
+		}
+		m.SelectOnly = selectOnly
+	}
+	return nil
+}
+
+// parseBtih accepts 40 hex or 32 base32 characters.
+func parseBtih(btih string) (string, error) {
+	switch len(btih) {
+	case 40:
+		if _, err := hex.DecodeString(btih); err != nil {
+			return "", fmt.Errorf("Invalid hex info hash %q", btih)
+		}
+		return strings.ToUpper(btih), nil
+	case 32:
+		decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(btih))
+		if err != nil {
+			return "", fmt.Errorf("Invalid base32 info hash %q", btih)
+		}
+		return strings.ToUpper(hex.EncodeToString(decoded)), nil
+	}
+	return "", fmt.Errorf("Invalid info hash %q: expected 40 hex or 32 base32 characters, got %v", btih, len(btih))
+}
+
+func validateMagnetURL(value string, schemes ...string) error {
+	parsedURL, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	for _, scheme := range schemes {
+		if strings.EqualFold(parsedURL.Scheme, scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported scheme %q", parsedURL.Scheme)
+}
+
+func validatePeerAddress(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber <= 0 || portNumber > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// parseSelectOnly parses BEP 53 file indices, ex: 0,2,4-6.
+func parseSelectOnly(value string) ([]int, error) {
+	selected := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 || first > maxSelectOnlyIndex {
+			return nil, fmt.Errorf("invalid file index %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first || last > maxSelectOnlyIndex {
+				return nil, fmt.Errorf("invalid file range %q", part)
+			}
+		}
+		for i := first; i <= last; i++ {
+			selected[i] = true
+		}
+	}
+
+	result := make([]int, 0, len(selected))
+	for index := range selected {
+		result = append(result, index)
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+type byMagnetKey []magnetKey
+
+func (s byMagnetKey) Len() int      { return len(s) }
+func (s byMagnetKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byMagnetKey) Less(i, j int) bool {
+	if s[i].name != s[j].name {
+		return s[i].name < s[j].name
+	}
+	if s[i].index != s[j].index {
+		return s[i].index < s[j].index
+	}
+	return s[i].key < s[j].key
+}
+
+// setAddTorrentParams adds the torrent by info hash, the magnet link itself
+// isn't handed to libtorrent.
+func (m *Magnet) setAddTorrentParams(addTorrentParams libtorrent.Add_torrent_params) {
+	infoHash, _ := hex.DecodeString(m.InfoHash)
+	addTorrentParams.SetInfo_hash(libtorrent.NewSha1_hash(string(infoHash)))
+	if m.DisplayName != "" {
+		addTorrentParams.SetName(m.DisplayName)
+	}
+
+	trackers := libtorrent.NewStdVectorString()
+	for _, tracker := range m.Trackers {
+		trackers.Add(tracker)
+	}
+	addTorrentParams.SetTrackers(trackers)
+
+	webSeeds := libtorrent.NewStdVectorString()
+	for _, webSeed := range m.WebSeeds {
+		webSeeds.Add(webSeed)
+	}
+	addTorrentParams.SetUrl_seeds(webSeeds)
+}
+
+// connectPeers resolves the x.pe peers, it must not run on the alert pump.
+func (m *Magnet) connectPeers(handle libtorrent.Torrent_handle) {
+	for _, peer := range m.Peers {
+		host, port, _ := net.SplitHostPort(peer)
+		portNumber, _ := strconv.Atoi(port)
+
+		addresses, err := net.LookupHost(host)
+		if err != nil {
+			log.Printf("[scrapmagnet] Failed to resolve peer %v: %v", peer, err)
+			continue
+		}
+		for _, address := range addresses {
+			// The torrent may have been removed while resolving
+			if !handle.Is_valid() {
+				return
+			}
+			ec := libtorrent.NewError_code()
+			peerAddress := libtorrent.Address_from_string(address, ec)
+			if ec.Value() != 0 {
+				continue
+			}
+			handle.Connect_peer(libtorrent.NewTcp_endpoint(peerAddress, uint16(portNumber)), 0)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBtih = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+func getTestBase32Btih() string {
+	infoHash, _ := hex.DecodeString(testBtih)
+	return base32.StdEncoding.EncodeToString(infoHash)
+}
+
+func TestParseMagnet(t *testing.T) {
+	infoHash := strings.ToUpper(testBtih)
+	tests := []struct {
+		link     string
+		expected *Magnet
+	}{
+		{
+			"magnet:?xt=urn:btih:" + testBtih,
+			&Magnet{InfoHash: infoHash},
+		},
+		{
+			"MAGNET:?xt=URN:BTIH:" + infoHash,
+			&Magnet{InfoHash: infoHash},
+		},
+		{
+			"magnet:?xt=urn:btih:" + getTestBase32Btih(),
+			&Magnet{InfoHash: infoHash},
+		},
+		{
+			"magnet:?xt=urn:btih:" + strings.ToLower(getTestBase32Btih()),
+			&Magnet{InfoHash: infoHash},
+		},
+		{
+			"magnet:?xt=urn:btmh:1220abcd&xt=urn:btih:" + testBtih + "&dn=Big+Buck+Bunny&xl=276134947",
+			&Magnet{InfoHash: infoHash, DisplayName: "Big Buck Bunny", ExactLength: 276134947},
+		},
+		{
+			"magnet:?xt.1=urn:btih:" + testBtih + "&xt.2=urn:btih:" + getTestBase32Btih(),
+			&Magnet{InfoHash: infoHash},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testBtih + "&tr.10=udp%3A%2F%2Fj%3A1&tr=udp%3A%2F%2Fa%3A1&tr.2=http%3A%2F%2Fc%2Fannounce&tr.1=https%3A%2F%2Fb%2Fannounce&tr.3=udp%3A%2F%2Fa%3A1",
+			&Magnet{InfoHash: infoHash, Trackers: []string{"udp://a:1", "https://b/announce", "http://c/announce", "udp://j:1"}},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testBtih + "&tr=wss%3A%2F%2Ftracker.example%3A443&tr=udp%3A%2F%2Fa%3A1&tr=udp%3A%2F%2F&ws=ftp%3A%2F%2Fseed.example%2Ff&ws=https%3A%2F%2Fseed.example%2Ff",
+			&Magnet{InfoHash: infoHash, Trackers: []string{"udp://a:1"}, WebSeeds: []string{"https://seed.example/f"}},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testBtih + "&x.pe=10.0.0.1%3A6881&x.pe=%5B%3A%3A1%5D%3A6881&x.pe=peer.example%3A51413",
+			&Magnet{InfoHash: infoHash, Peers: []string{"10.0.0.1:6881", "[::1]:6881", "peer.example:51413"}},
+		},
+		{
+			"magnet:?xt=urn:btih:" + testBtih + "&so=0,2,4-6,5",
+			&Magnet{InfoHash: infoHash, SelectOnly: []int{0, 2, 4, 5, 6}},
+		},
+	}
+
+	for _, test := range tests {
+		magnet, err := ParseMagnet(test.link)
+		if err != nil {
+			t.Errorf("ParseMagnet(%q) failed: %v", test.link, err)
+			continue
+		}
+		test.expected.Link = test.link
+		if !reflect.DeepEqual(magnet, test.expected) {
+			t.Errorf("ParseMagnet(%q) = %+v, expected %+v", test.link, magnet, test.expected)
+		}
+	}
+}
+
+func TestParseMagnetInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"http://example.com/?xt=urn:btih:" + testBtih,
+		"magnet:?dn=No+info+hash",
+		"magnet:?xt=urn:btmh:1220abcd",
+		"magnet:?xt=urn:btih:" + testBtih[:39],
+		"magnet:?xt=urn:btih:" + testBtih[:39] + "z",
+		"magnet:?xt=urn:btih:" + getTestBase32Btih()[:31] + "1",
+		"magnet:?xt=urn:btih:" + testBtih + "&xt=urn:btih:" + strings.Repeat("0", 40),
+		"magnet:?xt=urn:btih:" + testBtih + "&xl=-1",
+		"magnet:?xt=urn:btih:" + testBtih + "&xl=big",
+		"magnet:?xt=urn:btih:" + testBtih + "&x.pe=10.0.0.1",
+		"magnet:?xt=urn:btih:" + testBtih + "&x.pe=10.0.0.1%3A0",
+		"magnet:?xt=urn:btih:" + testBtih + "&x.pe=%3A6881",
+		"magnet:?xt=urn:btih:" + testBtih + "&so=",
+		"magnet:?xt=urn:btih:" + testBtih + "&so=1-",
+		"magnet:?xt=urn:btih:" + testBtih + "&so=3-1",
+		"magnet:?xt=urn:btih:" + testBtih + "&so=-1",
+		"magnet:?xt=urn:btih:" + testBtih + "&so=0-100001",
+		"magnet:?xt=urn:btih:" + testBtih + "&dn=%zz",
+	}
+
+	for _, test := range tests {
+		if magnet, err := ParseMagnet(test); err == nil {
+			t.Errorf("ParseMagnet(%q) = %+v, expected an error", test, magnet)
+		}
+	}
+}
+
+func TestParseSelectOnly(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []int
+	}{
+		{"0", []int{0}},
+		{"3,1,2", []int{1, 2, 3}},
+		{"1-3", []int{1, 2, 3}},
+		{"2-2", []int{2}},
+		{"0,2,4-6", []int{0, 2, 4, 5, 6}},
+		{"4-6,5-7,1", []int{1, 4, 5, 6, 7}},
+	}
+
+	for _, test := range tests {
+		result, err := parseSelectOnly(test.value)
+		if err != nil {
+			t.Errorf("parseSelectOnly(%q) failed: %v", test.value, err)
+		} else if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("parseSelectOnly(%q) = %v, expected %v", test.value, result, test.expected)
+		}
+	}
+}
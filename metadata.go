@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sharkone/libtorrent-go"
+)
+
+func getMetadataCachePath(infoHash string) string {
+	return filepath.Join(settings.metadataCacheDir, infoHash+".torrent")
+}
+
+func readCachedMetadata(infoHash string) ([]byte, error) {
+	return ioutil.ReadFile(getMetadataCachePath(infoHash))
+}
+
+// loadCachedMetadata returns nil when the metadata isn't cached or is invalid.
+func loadCachedMetadata(infoHash string) libtorrent.Torrent_info {
+	if settings.metadataCacheDir == "" {
+		return nil
+	}
+
+	torrentData, err := readCachedMetadata(infoHash)
+	if err != nil {
+		return nil
+	}
+
+	torrentInfo, err := newTorrentInfo(torrentData)
+	if err != nil {
+		log.Printf("[scrapmagnet] Invalid cached metadata for %v: %v", infoHash, err)
+		os.Remove(getMetadataCachePath(infoHash))
+		return nil
+	}
+
+	// Recently used entries are the last to be evicted
+	now := time.Now()
+	os.Chtimes(getMetadataCachePath(infoHash), now, now)
+
+	log.Printf("[scrapmagnet] Using cached metadata for %v", infoHash)
+	return torrentInfo
+}
+
+func cacheMetadata(infoHash string, torrentInfo libtorrent.Torrent_info) {
+	if settings.metadataCacheDir == "" || torrentInfo.Swigcptr() == 0 {
+		return
+	}
+
+	torrentData := []byte(libtorrent.Bencode(libtorrent.NewCreate_torrent(torrentInfo).Generate()))
+
+	// Regenerating the info dictionary may drop non standard keys
+	if generatedInfoHash, err := getTorrentFileInfoHash(torrentData); err != nil || generatedInfoHash != infoHash {
+		log.Printf("[scrapmagnet] Not caching metadata for %v, infohash mismatch", infoHash)
+		return
+	}
+
+	if err := os.MkdirAll(settings.metadataCacheDir, 0755); err != nil {
+		log.Print(err)
+		return
+	}
+
+	if err := writeFileAtomic(getMetadataCachePath(infoHash), torrentData, 0644); err != nil {
+		log.Print(err)
+		return
+	}
+
+	trimMetadataCache()
+}
+
+type byModTime []os.FileInfo
+
+func (a byModTime) Len() int           { return len(a) }
+func (a byModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byModTime) Less(i, j int) bool { return a[i].ModTime().Before(a[j].ModTime()) }
+
+// trimMetadataCache evicts the least recently used entries above the size cap.
+func trimMetadataCache() {
+	if settings.metadataCacheSize <= 0 {
+		return
+	}
+
+	fileInfos, err := ioutil.ReadDir(settings.metadataCacheDir)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	cacheEntries := make([]os.FileInfo, 0, len(fileInfos))
+	totalSize := int64(0)
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() && filepath.Ext(fileInfo.Name()) == ".torrent" {
+			cacheEntries = append(cacheEntries, fileInfo)
+			totalSize += fileInfo.Size()
+		}
+	}
+	sort.Sort(byModTime(cacheEntries))
+
+	maxSize := int64(settings.metadataCacheSize) * 1024 * 1024
+	for i := 0; i < len(cacheEntries) && totalSize > maxSize; i++ {
+		if err := os.Remove(filepath.Join(settings.metadataCacheDir, cacheEntries[i].Name())); err != nil {
+			log.Print(err)
+			continue
+		}
+		totalSize -= cacheEntries[i].Size()
+	}
+}
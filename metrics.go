@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sharkone/libtorrent-go"
+)
+
+// Metrics holds the counters updated as things happen, gauges are read from
+// the session when scraped.
+type Metrics struct {
+	mutex            sync.Mutex
+	servedBytes      map[string]int64
+	alerts           map[string]int64
+	hashFailures     map[string]int64
+	pieceWaits       int64
+	pieceWaitSeconds float64
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		servedBytes:  make(map[string]int64),
+		alerts:       make(map[string]int64),
+		hashFailures: make(map[string]int64),
+	}
+}
+
+func (m *Metrics) AddServedBytes(infoHash string, bytes int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.servedBytes[infoHash] += int64(bytes)
+}
+
+func (m *Metrics) IncAlert(alertType string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.alerts[alertType]++
+}
+
+func (m *Metrics) IncHashFailure(infoHash string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hashFailures[infoHash]++
+}
+
+// RemoveTorrent drops the counters of a removed torrent, so they don't pile
+// up with every torrent ever added.
+func (m *Metrics) RemoveTorrent(infoHash string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.servedBytes, infoHash)
+	delete(m.hashFailures, infoHash)
+}
+
+func (m *Metrics) AddPieceWait(duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pieceWaits++
+	m.pieceWaitSeconds += duration.Seconds()
+}
+
+type metricsWriter struct {
+	buffer  bytes.Buffer
+	written map[string]bool
+}
+
+func (mw *metricsWriter) write(name string, metricType string, help string, labels map[string]string, value interface{}) {
+	if !mw.written[name] {
+		fmt.Fprintf(&mw.buffer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+		mw.written[name] = true
+	}
+
+	mw.buffer.WriteString(name)
+	if len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", key, escapeLabelValue(labels[key])))
+		}
+		fmt.Fprintf(&mw.buffer, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(&mw.buffer, " %v\n", value)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func boolToMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	mw := &metricsWriter{written: make(map[string]bool)}
+	b := httpInstance.bitTorrent
+
+	sessionStatus := b.session.Status()
+	mw.write("scrapmagnet_session_download_rate_bytes", "gauge", "Session download rate in bytes per second.", nil, sessionStatus.GetDownload_rate())
+	mw.write("scrapmagnet_session_upload_rate_bytes", "gauge", "Session upload rate in bytes per second.", nil, sessionStatus.GetUpload_rate())
+	mw.write("scrapmagnet_session_downloaded_bytes_total", "counter", "Bytes downloaded by the session.", nil, sessionStatus.GetTotal_download())
+	mw.write("scrapmagnet_session_uploaded_bytes_total", "counter", "Bytes uploaded by the session.", nil, sessionStatus.GetTotal_upload())
+	mw.write("scrapmagnet_session_peers", "gauge", "Peers connected to the session.", nil, sessionStatus.GetNum_peers())
+	mw.write("scrapmagnet_session_dht_nodes", "gauge", "DHT nodes known to the session.", nil, sessionStatus.GetDht_nodes())
+
+	// Samples of a metric must be grouped, so torrents are walked per metric
+	type torrentSample struct {
+		labels         map[string]string
+		status         libtorrent.Torrent_status
+		connectionInfo *TorrentConnectionInfo
+	}
+	torrentSamples := make([]torrentSample, 0)
+	handles := b.session.Get_torrents()
+	for i := 0; i < int(handles.Size()); i++ {
+		handle := handles.Get(i)
+		infoHash := b.getTorrentInfoHash(handle)
+		if entry, ok := b.registry.Get(infoHash); ok && b.registry.IsActive(infoHash) {
+			torrentStatus := handle.Status()
+			torrentSamples = append(torrentSamples, torrentSample{
+				labels:         map[string]string{"info_hash": infoHash, "name": torrentStatus.GetName()},
+				status:         torrentStatus,
+				connectionInfo: entry.connectionInfo,
+			})
+		}
+	}
+
+	torrentMetrics := []struct {
+		name  string
+		help  string
+		value func(torrentSample) interface{}
+	}{
+		{"scrapmagnet_torrent_download_rate_bytes", "Torrent download rate in bytes per second.", func(ts torrentSample) interface{} { return ts.status.GetDownload_rate() }},
+		{"scrapmagnet_torrent_upload_rate_bytes", "Torrent upload rate in bytes per second.", func(ts torrentSample) interface{} { return ts.status.GetUpload_rate() }},
+		{"scrapmagnet_torrent_peers", "Peers connected to the torrent.", func(ts torrentSample) interface{} { return ts.status.GetNum_peers() }},
+		{"scrapmagnet_torrent_seeds", "Seeds connected to the torrent.", func(ts torrentSample) interface{} { return ts.status.GetNum_seeds() }},
+		{"scrapmagnet_torrent_progress", "Torrent download progress between 0 and 1.", func(ts torrentSample) interface{} { return ts.status.GetProgress() }},
+		{"scrapmagnet_torrent_paused", "Whether the torrent is paused.", func(ts torrentSample) interface{} { return boolToMetric(ts.status.GetPaused()) }},
+		{"scrapmagnet_torrent_http_connections", "HTTP connections streaming the torrent.", func(ts torrentSample) interface{} { return ts.connectionInfo.GetConnectionCount() }},
+	}
+	for _, torrentMetric := range torrentMetrics {
+		for _, ts := range torrentSamples {
+			mw.write(torrentMetric.name, "gauge", torrentMetric.help, ts.labels, torrentMetric.value(ts))
+		}
+	}
+
+	metrics.mutex.Lock()
+	for infoHash, servedBytes := range metrics.servedBytes {
+		mw.write("scrapmagnet_http_served_bytes_total", "counter", "Bytes served over HTTP.", map[string]string{"info_hash": infoHash}, servedBytes)
+	}
+	for alertType, count := range metrics.alerts {
+		mw.write("scrapmagnet_alerts_total", "counter", "libtorrent alerts received.", map[string]string{"type": alertType}, count)
+	}
+	for infoHash, count := range metrics.hashFailures {
+		mw.write("scrapmagnet_hash_failures_total", "counter", "Pieces failing the hash check.", map[string]string{"info_hash": infoHash}, count)
+	}
+	mw.write("scrapmagnet_piece_waits_total", "counter", "Reads and seeks blocked waiting for a piece.", nil, metrics.pieceWaits)
+	mw.write("scrapmagnet_piece_wait_seconds_total", "counter", "Time spent blocked waiting for pieces.", nil, metrics.pieceWaitSeconds)
+	metrics.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(mw.buffer.Bytes())
+}
@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drone/routes"
+)
+
+const (
+	ebmlBufferSize = 16 * 1024
+
+	// Elements read in memory are bounded, the others are seeked over
+	maxEBMLElementSize = 16 * 1024 * 1024
+
+	defaultTimecodeScale = 1000000
+
+	// Used for blocks without a duration, unless the next cue starts earlier
+	defaultCueDuration = 5 * time.Second
+)
+
+// Matroska element ids, see https://www.matroska.org/technical/elements.html
+const (
+	ebmlHeaderId             = 0x1A45DFA3
+	ebmlDocTypeId            = 0x4282
+	mkvSegmentId             = 0x18538067
+	mkvSeekHeadId            = 0x114D9B74
+	mkvSeekId                = 0x4DBB
+	mkvSeekIdId              = 0x53AB
+	mkvSeekPositionId        = 0x53AC
+	mkvInfoId                = 0x1549A966
+	mkvTimecodeScaleId       = 0x2AD7B1
+	mkvTracksId              = 0x1654AE6B
+	mkvTrackEntryId          = 0xAE
+	mkvTrackNumberId         = 0xD7
+	mkvTrackTypeId           = 0x83
+	mkvCodecId               = 0x86
+	mkvLanguageId            = 0x22B59C
+	mkvLanguageIETFId        = 0x22B59D
+	mkvNameId                = 0x536E
+	mkvFlagDefaultId         = 0x88
+	mkvFlagForcedId          = 0x55AA
+	mkvContentEncodingsId    = 0x6D80
+	mkvContentEncodingId     = 0x6240
+	mkvContentEncodingTypeId = 0x5033
+	mkvContentCompressionId  = 0x5034
+	mkvContentCompAlgoId     = 0x4254
+	mkvContentCompSettingsId = 0x4255
+	mkvCuesId                = 0x1C53BB6B
+	mkvCuePointId            = 0xBB
+	mkvCueTrackPositionsId   = 0xB7
+	mkvCueTrackId            = 0xF7
+	mkvCueClusterPositionId  = 0xF1
+	mkvCueRelativePositionId = 0xF0
+	mkvClusterId             = 0x1F43B675
+	mkvTimecodeId            = 0xE7
+	mkvSimpleBlockId         = 0xA3
+	mkvBlockGroupId          = 0xA0
+	mkvBlockId               = 0xA1
+	mkvBlockDurationId       = 0x9B
+
+	mkvTrackTypeSubtitle = 0x11
+
+	mkvCompressionNone            = -1
+	mkvCompressionZlib            = 0
+	mkvCompressionHeaderStripping = 3
+)
+
+var matroskaExtensions = map[string]bool{
+	".mkv":  true,
+	".mka":  true,
+	".mks":  true,
+	".webm": true,
+}
+
+// matroskaSubtitleCodecs are the text codecs which can be converted to WebVTT.
+var matroskaSubtitleCodecs = map[string]bool{
+	"S_TEXT/UTF8":   true,
+	"S_TEXT/ASS":    true,
+	"S_TEXT/SSA":    true,
+	"S_TEXT/WEBVTT": true,
+}
+
+var (
+	errNotMatroska       = errors.New("Not a Matroska file")
+	errMatroskaTrackSize = errors.New("Subtitle track too big to be converted")
+	errMatroskaNoCues    = errors.New("Subtitle track not indexed by the cues")
+)
+
+var (
+	assTagRegExp      = regexp.MustCompile(`\{[^}]*\}`)
+	assEscapeReplacer = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ")
+)
+
+// ebmlReader reads EBML elements from a torrent file. Skipped elements are
+// seeked over, so only the pieces holding what is read are waited for.
+type ebmlReader struct {
+	file   io.ReadSeeker
+	size   int64
+	buffer *bufio.Reader
+	pos    int64
+}
+
+type ebmlElement struct {
+	id        uint64
+	start     int64
+	dataStart int64
+	size      int64 // -1 when unknown
+}
+
+func (ee *ebmlElement) end() int64 {
+	return ee.dataStart + ee.size
+}
+
+func newEBMLReader(file io.ReadSeeker, size int64) *ebmlReader {
+	result := &ebmlReader{file: file, size: size}
+	result.buffer = bufio.NewReaderSize(result.limit(), ebmlBufferSize)
+	return result
+}
+
+// limit keeps reads within the file, reading past its end would wait for
+// pieces of the next one.
+func (er *ebmlReader) limit() io.Reader {
+	return &io.LimitedReader{R: er.file, N: er.size - er.pos}
+}
+
+func (er *ebmlReader) seek(pos int64) error {
+	if pos < 0 || pos > er.size {
+		return fmt.Errorf("Invalid position %v", pos)
+	}
+	if delta := pos - er.pos; delta >= 0 && delta <= int64(er.buffer.Buffered()) {
+		er.buffer.Discard(int(delta))
+		er.pos = pos
+		return nil
+	}
+
+	// Seeking to the end would wait for the last piece for nothing
+	if pos < er.size {
+		if _, err := er.file.Seek(pos, os.SEEK_SET); err != nil {
+			return err
+		}
+	}
+	er.pos = pos
+	er.buffer.Reset(er.limit())
+	return nil
+}
+
+func (er *ebmlReader) read(data []byte) error {
+	read, err := io.ReadFull(er.buffer, data)
+	er.pos += int64(read)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readVint reads a variable size integer, ids keep their length marker.
+func (er *ebmlReader) readVint(keepMarker bool) (uint64, int, error) {
+	var first [1]byte
+	if err := er.read(first[:]); err != nil {
+		return 0, 0, err
+	}
+
+	length := 1
+	for mask := byte(0x80); first[0]&mask == 0; mask >>= 1 {
+		if mask == 1 {
+			return 0, 0, fmt.Errorf("Invalid variable size integer at %v", er.pos-1)
+		}
+		length++
+	}
+
+	value := uint64(first[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> uint(length))
+	}
+	rest := make([]byte, length-1)
+	if err := er.read(rest); err != nil {
+		return 0, 0, err
+	}
+	for _, b := range rest {
+		value = value<<8 | uint64(b)
+	}
+	return value, length, nil
+}
+
+func (er *ebmlReader) readElement() (*ebmlElement, error) {
+	start := er.pos
+	id, idLength, err := er.readVint(true)
+	if err != nil {
+		return nil, err
+	}
+	if idLength > 4 {
+		return nil, fmt.Errorf("Invalid element id at %v", start)
+	}
+
+	size, sizeLength, err := er.readVint(false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ebmlElement{id: id, start: start, dataStart: er.pos, size: int64(size)}
+	if size == 1<<uint(7*sizeLength)-1 {
+		result.size = -1
+	} else if result.end() > er.size {
+		return nil, fmt.Errorf("Element %X at %v ends past the end of the file", id, start)
+	}
+	return result, nil
+}
+
+// readElementAt reads the header of the element at pos, which must be known.
+func (er *ebmlReader) readElementAt(pos int64, id uint64) (*ebmlElement, error) {
+	if err := er.seek(pos); err != nil {
+		return nil, err
+	}
+	result, err := er.readElement()
+	if err != nil {
+		return nil, err
+	}
+	if result.id != id {
+		return nil, fmt.Errorf("Expected element %X at %v, found %X", id, pos, result.id)
+	}
+	if result.size < 0 {
+		return nil, fmt.Errorf("Element %X at %v has an unknown size", id, pos)
+	}
+	return result, nil
+}
+
+func (er *ebmlReader) readData(element *ebmlElement) ([]byte, error) {
+	if element.size < 0 || element.size > maxEBMLElementSize {
+		return nil, fmt.Errorf("Element %X at %v is too big", element.id, element.start)
+	}
+	result := make([]byte, element.size)
+	return result, er.read(result)
+}
+
+func (er *ebmlReader) readUint(element *ebmlElement) (uint64, error) {
+	if element.size > 8 {
+		return 0, fmt.Errorf("Invalid integer element %X at %v", element.id, element.start)
+	}
+	data, err := er.readData(element)
+	if err != nil {
+		return 0, err
+	}
+
+	result := uint64(0)
+	for _, b := range data {
+		result = result<<8 | uint64(b)
+	}
+	return result, nil
+}
+
+func (er *ebmlReader) readString(element *ebmlElement) (string, error) {
+	data, err := er.readData(element)
+	return strings.TrimRight(string(data), "\x00"), err
+}
+
+// readChildren calls handle for each child of parent, the reader must be at
+// its data. Whatever handle read, the reader then moves to the next child.
+func (er *ebmlReader) readChildren(parent *ebmlElement, handle func(child *ebmlElement) error) error {
+	if parent.size < 0 {
+		return fmt.Errorf("Element %X at %v has an unknown size", parent.id, parent.start)
+	}
+
+	for er.pos < parent.end() {
+		child, err := er.readElement()
+		if err != nil {
+			return err
+		}
+		if child.size < 0 || child.end() > parent.end() {
+			return fmt.Errorf("Element %X at %v overflows its parent", child.id, child.start)
+		}
+		if err := handle(child); err != nil {
+			return err
+		}
+		if err := er.seek(child.end()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type MatroskaTrack struct {
+	Number    uint64 `json:"number"`
+	Codec     string `json:"codec"`
+	Language  string `json:"language,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Default   bool   `json:"default"`
+	Forced    bool   `json:"forced"`
+	Supported bool   `json:"supported"`
+
+	compression         int
+	compressionSettings []byte
+	encrypted           bool
+}
+
+// decode inflates at most limit+1 bytes, so callers can tell the block was
+// too big.
+func (mt *MatroskaTrack) decode(data []byte, limit int64) ([]byte, error) {
+	switch mt.compression {
+	case mkvCompressionHeaderStripping:
+		return append(append([]byte(nil), mt.compressionSettings...), data...), nil
+	case mkvCompressionZlib:
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	}
+	return data, nil
+}
+
+// getCueText returns the text of a block without styling, WebVTT cues cannot
+// hold blank lines nor arrows.
+func (mt *MatroskaTrack) getCueText(data []byte) string {
+	text := strings.TrimRight(decodeSubtitleText(data), "\x00")
+	switch mt.Codec {
+	case "S_TEXT/ASS", "S_TEXT/SSA":
+		// ReadOrder, Layer or Marked, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+		if fields := strings.SplitN(text, ",", 9); len(fields) == 9 {
+			text = fields[8]
+		}
+		text = assEscapeReplacer.Replace(assTagRegExp.ReplaceAllString(text, ""))
+	case "S_TEXT/UTF8":
+		text = srtTagRegExp.ReplaceAllString(text, "")
+	}
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.Replace(text, "\r", "\n", -1), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, strings.Replace(line, "-->", "->", -1))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type subtitleCue struct {
+	start time.Duration
+	end   time.Duration
+	text  string
+}
+
+// matroskaFile holds what the beginning of the file and the cues tell about
+// where subtitles are.
+type matroskaFile struct {
+	reader        *ebmlReader
+	segmentStart  int64
+	segmentEnd    int64
+	timecodeScale uint64
+	tracks        []*MatroskaTrack
+	tracksPos     int64
+	cuesPos       int64
+	cuePositions  map[uint64][]matroskaCuePosition
+
+	// Blocks decoded by the current extraction, bounded by maxSubtitleSize
+	decodedSize int64
+}
+
+// parseMatroska reads the level 1 elements up to the first cluster, the
+// others are found through the seek head.
+func parseMatroska(file io.ReadSeeker, size int64) (*matroskaFile, error) {
+	reader := newEBMLReader(file, size)
+	header, err := reader.readElement()
+	if err != nil {
+		return nil, err
+	}
+	if header.id != ebmlHeaderId {
+		return nil, errNotMatroska
+	}
+
+	docType := "matroska"
+	if err := reader.readChildren(header, func(child *ebmlElement) error {
+		var err error
+		if child.id == ebmlDocTypeId {
+			docType, err = reader.readString(child)
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if docType != "matroska" && docType != "webm" {
+		return nil, fmt.Errorf("Unsupported document type %q", docType)
+	}
+
+	segment, err := reader.readElement()
+	if err != nil {
+		return nil, err
+	}
+	if segment.id != mkvSegmentId {
+		return nil, errNotMatroska
+	}
+
+	result := &matroskaFile{
+		reader:        reader,
+		segmentStart:  segment.dataStart,
+		segmentEnd:    size,
+		timecodeScale: defaultTimecodeScale,
+		tracksPos:     -1,
+		cuesPos:       -1,
+	}
+	if segment.size >= 0 {
+		result.segmentEnd = segment.end()
+	}
+
+	for reader.pos < result.segmentEnd {
+		element, err := reader.readElement()
+		if err != nil {
+			return nil, err
+		}
+		if element.id == mkvClusterId {
+			break
+		}
+		if err := result.readLevel1(element); err != nil {
+			return nil, err
+		}
+		if err := reader.seek(element.end()); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.tracks == nil && result.tracksPos >= 0 {
+		tracks, err := reader.readElementAt(result.tracksPos, mkvTracksId)
+		if err != nil {
+			return nil, err
+		}
+		if err := result.readTracks(tracks); err != nil {
+			return nil, err
+		}
+	}
+	if result.tracks == nil {
+		return nil, errors.New("Matroska file has no tracks")
+	}
+	return result, nil
+}
+
+func (mf *matroskaFile) readLevel1(element *ebmlElement) error {
+	if element.size < 0 {
+		return fmt.Errorf("Element %X at %v has an unknown size", element.id, element.start)
+	}
+
+	switch element.id {
+	case mkvSeekHeadId:
+		return mf.readSeekHead(element)
+	case mkvInfoId:
+		return mf.reader.readChildren(element, func(child *ebmlElement) error {
+			if child.id != mkvTimecodeScaleId {
+				return nil
+			}
+			timecodeScale, err := mf.reader.readUint(child)
+			if timecodeScale > 0 {
+				mf.timecodeScale = timecodeScale
+			}
+			return err
+		})
+	case mkvTracksId:
+		return mf.readTracks(element)
+	case mkvCuesId:
+		return mf.readCues(element)
+	}
+	return nil
+}
+
+func (mf *matroskaFile) readSeekHead(element *ebmlElement) error {
+	return mf.reader.readChildren(element, func(seek *ebmlElement) error {
+		if seek.id != mkvSeekId {
+			return nil
+		}
+
+		id, position := uint64(0), uint64(0)
+		if err := mf.reader.readChildren(seek, func(child *ebmlElement) error {
+			var err error
+			switch child.id {
+			case mkvSeekIdId:
+				id, err = mf.reader.readUint(child)
+			case mkvSeekPositionId:
+				position, err = mf.reader.readUint(child)
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+
+		switch id {
+		case mkvTracksId:
+			mf.tracksPos = mf.segmentStart + int64(position)
+		case mkvCuesId:
+			mf.cuesPos = mf.segmentStart + int64(position)
+		}
+		return nil
+	})
+}
+
+// readTracks only keeps subtitle tracks.
+func (mf *matroskaFile) readTracks(element *ebmlElement) error {
+	mf.tracks = make([]*MatroskaTrack, 0)
+	return mf.reader.readChildren(element, func(entry *ebmlElement) error {
+		if entry.id != mkvTrackEntryId {
+			return nil
+		}
+
+		// Defaults from the specification
+		track := &MatroskaTrack{Language: "eng", Default: true, compression: mkvCompressionNone}
+		trackType, languageIETF := uint64(0), ""
+		if err := mf.reader.readChildren(entry, func(child *ebmlElement) error {
+			var err error
+			var flag uint64
+			switch child.id {
+			case mkvTrackNumberId:
+				track.Number, err = mf.reader.readUint(child)
+			case mkvTrackTypeId:
+				trackType, err = mf.reader.readUint(child)
+			case mkvCodecId:
+				track.Codec, err = mf.reader.readString(child)
+			case mkvLanguageId:
+				track.Language, err = mf.reader.readString(child)
+			case mkvLanguageIETFId:
+				languageIETF, err = mf.reader.readString(child)
+			case mkvNameId:
+				track.Name, err = mf.reader.readString(child)
+			case mkvFlagDefaultId:
+				flag, err = mf.reader.readUint(child)
+				track.Default = flag != 0
+			case mkvFlagForcedId:
+				flag, err = mf.reader.readUint(child)
+				track.Forced = flag != 0
+			case mkvContentEncodingsId:
+				err = mf.readContentEncodings(child, track)
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+
+		if trackType != mkvTrackTypeSubtitle || track.Number == 0 {
+			return nil
+		}
+		if languageIETF != "" {
+			track.Language = languageIETF
+		}
+		track.Supported = matroskaSubtitleCodecs[track.Codec] && !track.encrypted &&
+			(track.compression == mkvCompressionNone || track.compression == mkvCompressionZlib || track.compression == mkvCompressionHeaderStripping)
+		mf.tracks = append(mf.tracks, track)
+		return nil
+	})
+}
+
+// readContentEncodings finds how blocks are compressed, mkvmerge used to
+// compress text subtitles with zlib by default.
+func (mf *matroskaFile) readContentEncodings(element *ebmlElement, track *MatroskaTrack) error {
+	return mf.reader.readChildren(element, func(encoding *ebmlElement) error {
+		if encoding.id != mkvContentEncodingId {
+			return nil
+		}
+
+		encodingType, algorithm, compressionSettings := uint64(0), uint64(mkvCompressionZlib), []byte(nil)
+		if err := mf.reader.readChildren(encoding, func(child *ebmlElement) error {
+			var err error
+			switch child.id {
+			case mkvContentEncodingTypeId:
+				encodingType, err = mf.reader.readUint(child)
+			case mkvContentCompressionId:
+				err = mf.reader.readChildren(child, func(compression *ebmlElement) error {
+					var err error
+					switch compression.id {
+					case mkvContentCompAlgoId:
+						algorithm, err = mf.reader.readUint(compression)
+					case mkvContentCompSettingsId:
+						compressionSettings, err = mf.reader.readData(compression)
+					}
+					return err
+				})
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+
+		if encodingType != 0 {
+			track.encrypted = true
+		} else {
+			track.compression = int(algorithm)
+			track.compressionSettings = compressionSettings
+		}
+		return nil
+	})
+}
+
+// matroskaCuePosition locates a block, relative to the data of its cluster.
+// It's -1 when the cues only tell the cluster.
+type matroskaCuePosition struct {
+	cluster  int64
+	relative int64
+}
+
+func (mf *matroskaFile) readCues(element *ebmlElement) error {
+	mf.cuePositions = make(map[uint64][]matroskaCuePosition)
+	return mf.reader.readChildren(element, func(point *ebmlElement) error {
+		if point.id != mkvCuePointId {
+			return nil
+		}
+		return mf.reader.readChildren(point, func(positions *ebmlElement) error {
+			if positions.id != mkvCueTrackPositionsId {
+				return nil
+			}
+
+			track, cluster, relative, found := uint64(0), uint64(0), int64(-1), false
+			if err := mf.reader.readChildren(positions, func(child *ebmlElement) error {
+				var err error
+				switch child.id {
+				case mkvCueTrackId:
+					track, err = mf.reader.readUint(child)
+				case mkvCueClusterPositionId:
+					cluster, err = mf.reader.readUint(child)
+					found = true
+				case mkvCueRelativePositionId:
+					var value uint64
+					value, err = mf.reader.readUint(child)
+					relative = int64(value)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+
+			if found {
+				mf.cuePositions[track] = append(mf.cuePositions[track], matroskaCuePosition{cluster: mf.segmentStart + int64(cluster), relative: relative})
+			}
+			return nil
+		})
+	})
+}
+
+func (mf *matroskaFile) getTrack(number uint64) *MatroskaTrack {
+	for _, track := range mf.tracks {
+		if track.Number == number {
+			return track
+		}
+	}
+	return nil
+}
+
+// getCuePositions returns the blocks of the track, none when the cues don't
+// index it.
+func (mf *matroskaFile) getCuePositions(track *MatroskaTrack) ([]matroskaCuePosition, error) {
+	if mf.cuePositions == nil && mf.cuesPos >= 0 {
+		cues, err := mf.reader.readElementAt(mf.cuesPos, mkvCuesId)
+		if err != nil {
+			return nil, err
+		}
+		if err := mf.readCues(cues); err != nil {
+			return nil, err
+		}
+	}
+
+	positions := append([]matroskaCuePosition(nil), mf.cuePositions[track.Number]...)
+	sort.Sort(byCuePosition(positions))
+	result := make([]matroskaCuePosition, 0, len(positions))
+	for i, position := range positions {
+		if i == 0 || position != positions[i-1] {
+			result = append(result, position)
+		}
+	}
+	return result, nil
+}
+
+// extractTrack only reads the blocks the cues point to, or their clusters
+// when the cues don't tell where blocks are. Tracks without cues aren't
+// extracted, walking every cluster would download the whole file.
+func (mf *matroskaFile) extractTrack(track *MatroskaTrack) ([]*subtitleCue, error) {
+	positions, err := mf.getCuePositions(track)
+	if err != nil {
+		return nil, err
+	}
+	if len(positions) == 0 {
+		return nil, errMatroskaNoCues
+	}
+
+	mf.decodedSize = 0
+	result := make([]*subtitleCue, 0)
+	for start := 0; start < len(positions); {
+		end := start + 1
+		for end < len(positions) && positions[end].cluster == positions[start].cluster {
+			end++
+		}
+		cues, err := mf.readCuedBlocks(positions[start:end], track)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, cues...)
+		start = end
+	}
+
+	sort.Stable(bySubtitleCueStart(result))
+	for i, cue := range result {
+		if cue.end > cue.start {
+			continue
+		}
+		cue.end = cue.start + defaultCueDuration
+		if i+1 < len(result) && result[i+1].start > cue.start && result[i+1].start < cue.end {
+			cue.end = result[i+1].start
+		}
+	}
+	return result, nil
+}
+
+// readCuedBlocks reads the blocks of a cluster, positions are sorted so the
+// ones only telling the cluster come first.
+func (mf *matroskaFile) readCuedBlocks(positions []matroskaCuePosition, track *MatroskaTrack) ([]*subtitleCue, error) {
+	cluster, err := mf.reader.readElementAt(positions[0].cluster, mkvClusterId)
+	if err != nil {
+		return nil, err
+	}
+	if positions[0].relative < 0 {
+		return mf.readCluster(cluster, track)
+	}
+
+	// The timecode comes first, the other children are seeked over
+	element, err := mf.reader.readElement()
+	if err != nil {
+		return nil, err
+	}
+	if element.id != mkvTimecodeId {
+		if err := mf.reader.seek(cluster.dataStart); err != nil {
+			return nil, err
+		}
+		return mf.readCluster(cluster, track)
+	}
+	value, err := mf.reader.readUint(element)
+	if err != nil {
+		return nil, err
+	}
+	timecode := int64(value)
+
+	result := make([]*subtitleCue, 0)
+	for _, position := range positions {
+		if err := mf.reader.seek(cluster.dataStart + position.relative); err != nil {
+			return nil, err
+		}
+		block, err := mf.reader.readElement()
+		if err != nil {
+			return nil, err
+		}
+		if block.size < 0 || block.end() > cluster.end() {
+			return nil, fmt.Errorf("Element %X at %v overflows its parent", block.id, block.start)
+		}
+		cue, err := mf.readClusterBlock(block, track, timecode)
+		if err != nil {
+			return nil, err
+		}
+		if cue != nil {
+			result = append(result, cue)
+		}
+	}
+	return result, nil
+}
+
+func (mf *matroskaFile) readCluster(cluster *ebmlElement, track *MatroskaTrack) ([]*subtitleCue, error) {
+	result := make([]*subtitleCue, 0)
+	timecode := int64(0)
+	err := mf.reader.readChildren(cluster, func(child *ebmlElement) error {
+		if child.id == mkvTimecodeId {
+			value, err := mf.reader.readUint(child)
+			timecode = int64(value)
+			return err
+		}
+
+		cue, err := mf.readClusterBlock(child, track, timecode)
+		if cue != nil {
+			result = append(result, cue)
+		}
+		return err
+	})
+	return result, err
+}
+
+// readClusterBlock returns nil for children which aren't blocks of the track.
+func (mf *matroskaFile) readClusterBlock(child *ebmlElement, track *MatroskaTrack, timecode int64) (*subtitleCue, error) {
+	switch child.id {
+	case mkvSimpleBlockId:
+		return mf.readBlock(child, track, timecode)
+	case mkvBlockGroupId:
+		var cue *subtitleCue
+		duration := int64(-1)
+		err := mf.reader.readChildren(child, func(groupChild *ebmlElement) error {
+			var err error
+			switch groupChild.id {
+			case mkvBlockId:
+				cue, err = mf.readBlock(groupChild, track, timecode)
+			case mkvBlockDurationId:
+				var value uint64
+				value, err = mf.reader.readUint(groupChild)
+				duration = int64(value)
+			}
+			return err
+		})
+		if cue != nil && duration >= 0 {
+			cue.end = cue.start + mf.toDuration(duration)
+		}
+		return cue, err
+	}
+	return nil, nil
+}
+
+// readBlock returns nil for blocks of other tracks, only their track number
+// is read.
+func (mf *matroskaFile) readBlock(block *ebmlElement, track *MatroskaTrack, clusterTimecode int64) (*subtitleCue, error) {
+	trackNumber, _, err := mf.reader.readVint(false)
+	if err != nil || trackNumber != track.Number {
+		return nil, err
+	}
+
+	// Relative timecode and flags
+	var header [3]byte
+	if err := mf.reader.read(header[:]); err != nil {
+		return nil, err
+	}
+	// Subtitles are never laced
+	if header[2]&0x06 != 0 {
+		return nil, nil
+	}
+
+	data, err := mf.reader.readData(&ebmlElement{id: block.id, start: block.start, size: block.end() - mf.reader.pos})
+	if err != nil {
+		return nil, err
+	}
+	if data, err = track.decode(data, maxSubtitleSize-mf.decodedSize); err != nil {
+		return nil, fmt.Errorf("Failed to decode block at %v: %v", block.start, err)
+	}
+	if mf.decodedSize += int64(len(data)); mf.decodedSize > maxSubtitleSize {
+		return nil, errMatroskaTrackSize
+	}
+
+	start := mf.toDuration(clusterTimecode + int64(int16(binary.BigEndian.Uint16(header[:2]))))
+	if start < 0 {
+		start = 0
+	}
+	return &subtitleCue{start: start, text: track.getCueText(data)}, nil
+}
+
+func (mf *matroskaFile) toDuration(timecode int64) time.Duration {
+	return time.Duration(timecode * int64(mf.timecodeScale))
+}
+
+func formatWebVTT(cues []*subtitleCue) []byte {
+	var result bytes.Buffer
+	result.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		if cue.text != "" {
+			fmt.Fprintf(&result, "%s --> %s\n%s\n\n", formatVTTDuration(cue.start), formatVTTDuration(cue.end), cue.text)
+		}
+	}
+	return result.Bytes()
+}
+
+func formatVTTDuration(duration time.Duration) string {
+	milliseconds := int64(duration / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, milliseconds%1000)
+}
+
+// apiEmbeddedSubtitles lists the subtitle tracks of a Matroska file, or serves
+// the :track one as WebVTT.
+func apiEmbeddedSubtitles(w http.ResponseWriter, r *http.Request) {
+	torrentInfo := httpInstance.bitTorrent.GetTorrentInfo(getInfoHashParam(r))
+	if torrentInfo == nil {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get(":index"))
+	if err != nil {
+		http.Error(w, "Invalid file index", http.StatusBadRequest)
+		return
+	}
+
+	torrentFileInfo := torrentInfo.GetTorrentFileInfoByIndex(index)
+	if torrentFileInfo == nil {
+		fileNotFound(w, torrentInfo)
+		return
+	}
+	if !matroskaExtensions[strings.ToLower(path.Ext(torrentFileInfo.Path))] {
+		http.Error(w, "Only Matroska files have embedded subtitles", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	trackNumber := uint64(0)
+	if param := r.URL.Query().Get(":track"); param != "" {
+		if trackNumber, err = strconv.ParseUint(param, 10, 64); err != nil || trackNumber == 0 {
+			http.Error(w, "Invalid track number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	httpInstance.bitTorrent.AddConnection(torrentInfo.InfoHash)
+	defer httpInstance.bitTorrent.RemoveConnection(torrentInfo.InfoHash)
+
+	if err := torrentFileInfo.Open(r.Context(), torrentInfo.DownloadDir); err != nil {
+		fileOpenFailed(w, err)
+		return
+	}
+	defer torrentFileInfo.Close()
+
+	matroska, err := parseMatroska(torrentFileInfo.NewReader(), torrentFileInfo.Size)
+	if err != nil {
+		matroskaReadFailed(w, err)
+		return
+	}
+	if trackNumber == 0 {
+		routes.ServeJson(w, matroska.tracks)
+		return
+	}
+
+	track := matroska.getTrack(trackNumber)
+	if track == nil {
+		serveJsonStatus(w, http.StatusNotFound, map[string]interface{}{"error": "Subtitle track not found", "tracks": matroska.tracks})
+		return
+	} else if !track.Supported {
+		http.Error(w, fmt.Sprintf("Cannot convert %v subtitles to vtt", track.Codec), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	cues, err := matroska.extractTrack(track)
+	if err != nil {
+		matroskaReadFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", subtitleContentTypes["vtt"])
+	name := fmt.Sprintf("%v.%v.vtt", strings.TrimSuffix(torrentFileInfo.Path, path.Ext(torrentFileInfo.Path)), trackNumber)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(formatWebVTT(cues)))
+}
+
+func matroskaReadFailed(w http.ResponseWriter, err error) {
+	if _, ok := err.(*os.PathError); ok {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+	} else if err == errMatroskaTrackSize {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	} else if err == errMatroskaNoCues {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else if err == context.DeadlineExceeded {
+		http.Error(w, "Timed out waiting for file", http.StatusGatewayTimeout)
+	} else if err != context.Canceled {
+		http.Error(w, "Invalid Matroska file: "+err.Error(), http.StatusUnprocessableEntity)
+	}
+}
+
+type byCuePosition []matroskaCuePosition
+
+func (s byCuePosition) Len() int      { return len(s) }
+func (s byCuePosition) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCuePosition) Less(i, j int) bool {
+	return s[i].cluster < s[j].cluster || (s[i].cluster == s[j].cluster && s[i].relative < s[j].relative)
+}
+
+type bySubtitleCueStart []*subtitleCue
+
+func (s bySubtitleCueStart) Len() int           { return len(s) }
+func (s bySubtitleCueStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySubtitleCueStart) Less(i, j int) bool { return s[i].start < s[j].start }
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+)
+
+// ebmlBytes encodes an element, ids are written with their length marker.
+func ebmlBytes(id uint64, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+
+	idBytes := make([]byte, 0)
+	for shift := uint(24); ; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(idBytes) > 0 || shift == 0 {
+			idBytes = append(idBytes, b)
+		}
+		if shift == 0 {
+			break
+		}
+	}
+	return append(append(idBytes, ebmlSize(uint64(len(data)))...), data...)
+}
+
+// ebmlSize encodes a size on 8 bytes, the longest form.
+func ebmlSize(size uint64) []byte {
+	result := []byte{0x01, 0, 0, 0, 0, 0, 0, 0}
+	for i := 7; i > 0; i-- {
+		result[i] = byte(size)
+		size >>= 8
+	}
+	return result
+}
+
+func ebmlUint(id uint64, value uint64) []byte {
+	return ebmlBytes(id, []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)})
+}
+
+func ebmlString(id uint64, value string) []byte {
+	return ebmlBytes(id, []byte(value))
+}
+
+func mkvBlock(track byte, timecode int16, payload []byte) []byte {
+	return append([]byte{0x80 | track, byte(timecode >> 8), byte(timecode), 0x80}, payload...)
+}
+
+func zlibBytes(data []byte) []byte {
+	var result bytes.Buffer
+	writer := zlib.NewWriter(&result)
+	writer.Write(data)
+	writer.Close()
+	return result.Bytes()
+}
+
+// mkvTestCue points to a block of track 3, relative to the data of the
+// cluster at index cluster, or to the cluster only when relative is -1.
+type mkvTestCue struct {
+	cluster  int
+	relative int
+}
+
+// mkvCues encodes the cues with positions on 4 bytes, their size doesn't
+// depend on the cluster positions.
+func mkvCues(cuePoints []mkvTestCue, clusterPositions []int) []byte {
+	points := make([][]byte, 0)
+	for _, cuePoint := range cuePoints {
+		positions := [][]byte{ebmlUint(mkvCueTrackId, 3), ebmlUint(mkvCueClusterPositionId, uint64(clusterPositions[cuePoint.cluster]))}
+		if cuePoint.relative >= 0 {
+			positions = append(positions, ebmlUint(mkvCueRelativePositionId, uint64(cuePoint.relative)))
+		}
+		points = append(points, ebmlBytes(mkvCuePointId, ebmlBytes(mkvCueTrackPositionsId, positions...)))
+	}
+	return ebmlBytes(mkvCuesId, points...)
+}
+
+// newTestMatroska writes the cues before the clusters, unless cuePoints is
+// nil.
+func newTestMatroska(cuePoints []mkvTestCue, clusters ...[]byte) []byte {
+	header := ebmlBytes(ebmlHeaderId, ebmlString(ebmlDocTypeId, "matroska"))
+	info := ebmlBytes(mkvInfoId, ebmlUint(mkvTimecodeScaleId, 1000000))
+	tracks := ebmlBytes(mkvTracksId,
+		ebmlBytes(mkvTrackEntryId,
+			ebmlUint(mkvTrackNumberId, 1),
+			ebmlUint(mkvTrackTypeId, 1),
+			ebmlString(mkvCodecId, "V_MPEG4/ISO/AVC"),
+		),
+		ebmlBytes(mkvTrackEntryId,
+			ebmlUint(mkvTrackNumberId, 3),
+			ebmlUint(mkvTrackTypeId, mkvTrackTypeSubtitle),
+			ebmlString(mkvCodecId, "S_TEXT/UTF8"),
+			ebmlString(mkvLanguageId, "fre"),
+			ebmlUint(mkvFlagDefaultId, 0),
+			ebmlBytes(mkvContentEncodingsId,
+				ebmlBytes(mkvContentEncodingId,
+					ebmlBytes(mkvContentCompressionId, ebmlUint(mkvContentCompAlgoId, mkvCompressionZlib)),
+				),
+			),
+		),
+	)
+
+	children := [][]byte{info, tracks}
+	if cuePoints != nil {
+		clusterPositions := make([]int, len(clusters))
+		position := len(info) + len(tracks) + len(mkvCues(cuePoints, clusterPositions))
+		for i, cluster := range clusters {
+			clusterPositions[i] = position
+			position += len(cluster)
+		}
+		children = append(children, mkvCues(cuePoints, clusterPositions))
+	}
+	segment := ebmlBytes(mkvSegmentId, append(children, clusters...)...)
+	return append(header, segment...)
+}
+
+func TestEBMLReaderReadVint(t *testing.T) {
+	tests := []struct {
+		data       []byte
+		keepMarker bool
+		value      uint64
+		length     int
+	}{
+		{[]byte{0x81}, false, 1, 1},
+		{[]byte{0x81}, true, 0x81, 1},
+		{[]byte{0x40, 0x02}, false, 2, 2},
+		{[]byte{0x1A, 0x45, 0xDF, 0xA3}, true, ebmlHeaderId, 4},
+		{[]byte{0x01, 0, 0, 0, 0, 0, 0x01, 0x00}, false, 256, 8},
+	}
+
+	for _, test := range tests {
+		reader := newEBMLReader(bytes.NewReader(test.data), int64(len(test.data)))
+		value, length, err := reader.readVint(test.keepMarker)
+		if err != nil || value != test.value || length != test.length {
+			t.Errorf("readVint(%X) = %X, %v, %v, expected %X, %v", test.data, value, length, err, test.value, test.length)
+		}
+	}
+
+	invalid := [][]byte{
+		{},
+		{0x00, 0x01},
+		{0x40},
+		{0x01, 0, 0, 0},
+	}
+	for _, test := range invalid {
+		reader := newEBMLReader(bytes.NewReader(test), int64(len(test)))
+		if value, _, err := reader.readVint(false); err == nil {
+			t.Errorf("readVint(%X) = %X, expected an error", test, value)
+		}
+	}
+}
+
+func TestEBMLReaderReadElement(t *testing.T) {
+	element := ebmlString(mkvCodecId, "S_TEXT/UTF8")
+	reader := newEBMLReader(bytes.NewReader(element), int64(len(element)))
+	result, err := reader.readElement()
+	if err != nil || result.id != mkvCodecId || result.size != 11 || result.dataStart != 9 {
+		t.Fatalf("readElement() = %+v, %v", result, err)
+	}
+	if value, err := reader.readString(result); err != nil || value != "S_TEXT/UTF8" {
+		t.Errorf("readString() = %q, %v", value, err)
+	}
+
+	unknownSize := []byte{0x18, 0x53, 0x80, 0x67, 0xFF}
+	reader = newEBMLReader(bytes.NewReader(unknownSize), int64(len(unknownSize)))
+	if result, err := reader.readElement(); err != nil || result.size != -1 {
+		t.Errorf("readElement() of an unknown size = %+v, %v", result, err)
+	}
+
+	invalid := map[string][]byte{
+		"truncated id":   {0x1A, 0x45},
+		"truncated size": {0x86, 0x40},
+		"id too long":    {0x08, 0, 0, 0, 0, 0x80},
+		"past the end":   element[:len(element)-1],
+	}
+	for name, test := range invalid {
+		reader := newEBMLReader(bytes.NewReader(test), int64(len(test)))
+		if result, err := reader.readElement(); err == nil {
+			t.Errorf("readElement() of %v = %+v, expected an error", name, result)
+		}
+	}
+}
+
+func TestEBMLReaderReadChildren(t *testing.T) {
+	// The parent claims 3 bytes while its child needs 4
+	overflow := []byte{0xAE, 0x83, 0xD7, 0x82, 0x00, 0x01}
+	reader := newEBMLReader(bytes.NewReader(overflow), int64(len(overflow)))
+	parent, err := reader.readElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.readChildren(parent, func(child *ebmlElement) error { return nil }); err == nil || !strings.Contains(err.Error(), "overflows") {
+		t.Errorf("readChildren() = %v, expected the child to overflow", err)
+	}
+
+	data := ebmlBytes(mkvTrackEntryId, ebmlUint(mkvTrackNumberId, 3), ebmlString(mkvCodecId, "S_TEXT/UTF8"))
+	reader = newEBMLReader(bytes.NewReader(data), int64(len(data)))
+	parent, _ = reader.readElement()
+	ids := make([]uint64, 0)
+	if err := reader.readChildren(parent, func(child *ebmlElement) error {
+		ids = append(ids, child.id)
+		return nil
+	}); err != nil || len(ids) != 2 || ids[0] != mkvTrackNumberId || ids[1] != mkvCodecId {
+		t.Errorf("readChildren() = %v, read %X", err, ids)
+	}
+
+	hugeElement := append([]byte{0x86}, ebmlSize(maxEBMLElementSize+1)...)
+	reader = newEBMLReader(bytes.NewReader(hugeElement), maxEBMLElementSize*2)
+	element, err := reader.readElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.readData(element); err == nil {
+		t.Error("readData() of an element too big succeeded")
+	}
+}
+
+// countingReader records the ranges read, skipped bytes must never be.
+type countingReader struct {
+	*bytes.Reader
+	read map[int64]bool
+}
+
+func (cr *countingReader) Read(data []byte) (int, error) {
+	position, _ := cr.Seek(0, io.SeekCurrent)
+	read, err := cr.Reader.Read(data)
+	for i := int64(0); i < int64(read); i++ {
+		cr.read[position+i] = true
+	}
+	return read, err
+}
+
+func TestMatroskaExtractTrack(t *testing.T) {
+	timecode := ebmlUint(mkvTimecodeId, 1000)
+	video := ebmlBytes(mkvSimpleBlockId, mkvBlock(1, 0, bytes.Repeat([]byte("video"), 10000)))
+	group := ebmlBytes(mkvBlockGroupId,
+		ebmlBytes(mkvBlockId, mkvBlock(3, 500, zlibBytes([]byte("<i>Bonjour</i>\r\nà tous")))),
+		ebmlUint(mkvBlockDurationId, 1500),
+	)
+	simple := ebmlBytes(mkvSimpleBlockId, mkvBlock(3, 4000, zlibBytes([]byte("Salut --> toi"))))
+	otherVideo := ebmlBytes(mkvSimpleBlockId, mkvBlock(1, 0, bytes.Repeat([]byte("other"), 10000)))
+	expected := "WEBVTT\n\n" +
+		"00:00:01.500 --> 00:00:03.000\n<i>Bonjour</i>\nà tous\n\n" +
+		"00:00:05.000 --> 00:00:10.000\nSalut -> toi\n\n"
+
+	tests := map[string][]mkvTestCue{
+		"blocks":             {{0, len(timecode) + len(video) + len(group)}, {0, len(timecode) + len(video)}, {0, len(timecode) + len(video)}},
+		"clusters":           {{0, -1}},
+		"blocks and cluster": {{0, len(timecode) + len(video)}, {0, -1}},
+	}
+	for name, cuePoints := range tests {
+		data := newTestMatroska(cuePoints, ebmlBytes(mkvClusterId, timecode, video, group, simple), ebmlBytes(mkvClusterId, otherVideo))
+		reader := &countingReader{Reader: bytes.NewReader(data), read: make(map[int64]bool)}
+
+		matroska, err := parseMatroska(reader, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matroska.tracks) != 1 || matroska.tracks[0].Number != 3 || matroska.tracks[0].Language != "fre" || matroska.tracks[0].Default || !matroska.tracks[0].Supported {
+			t.Fatalf("Tracks are %+v", matroska.tracks)
+		}
+
+		cues, err := matroska.extractTrack(matroska.tracks[0])
+		if err != nil {
+			t.Fatalf("extractTrack() of %v = %v", name, err)
+		}
+		if result := string(formatWebVTT(cues)); result != expected {
+			t.Errorf("formatWebVTT() of %v = %q, expected %q", name, result, expected)
+		}
+
+		// The buffer may read a little past what is needed
+		videoData := int64(bytes.Index(data, video) + len(video)/2)
+		otherVideoData := int64(bytes.Index(data, otherVideo) + len(otherVideo)/2)
+		if reader.read[videoData] && name == "blocks" {
+			t.Errorf("extractTrack() of %v read video blocks", name)
+		}
+		if reader.read[otherVideoData] {
+			t.Errorf("extractTrack() of %v read a cluster not indexed by the cues", name)
+		}
+	}
+}
+
+func TestMatroskaExtractTrackWithoutCues(t *testing.T) {
+	cluster := ebmlBytes(mkvClusterId, ebmlUint(mkvTimecodeId, 0), ebmlBytes(mkvSimpleBlockId, mkvBlock(3, 0, zlibBytes([]byte("Bonjour")))))
+	for _, cuePoints := range [][]mkvTestCue{nil, {}} {
+		data := newTestMatroska(cuePoints, cluster)
+		matroska, err := parseMatroska(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := matroska.extractTrack(matroska.tracks[0]); err != errMatroskaNoCues {
+			t.Errorf("extractTrack() = %v, expected %v", err, errMatroskaNoCues)
+		}
+	}
+}
+
+func TestMatroskaExtractTrackTooBig(t *testing.T) {
+	// Each block is small and decodes below the limit, all of them don't
+	block := zlibBytes(bytes.Repeat([]byte("a"), 1024*1024))
+	clusters := make([][]byte, 0)
+	cuePoints := make([]mkvTestCue, 0)
+	for i := 0; i < maxSubtitleSize/(1024*1024)+1; i++ {
+		clusters = append(clusters, ebmlBytes(mkvClusterId, ebmlUint(mkvTimecodeId, uint64(i)*1000), ebmlBytes(mkvSimpleBlockId, mkvBlock(3, 0, block))))
+		cuePoints = append(cuePoints, mkvTestCue{i, -1})
+	}
+	data := newTestMatroska(cuePoints, clusters...)
+
+	matroska, err := parseMatroska(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := matroska.extractTrack(matroska.tracks[0]); err != errMatroskaTrackSize {
+		t.Errorf("extractTrack() = %v, expected %v", err, errMatroskaTrackSize)
+	}
+}
+
+func TestParseMatroskaInvalid(t *testing.T) {
+	data := newTestMatroska(nil)
+	tests := map[string][]byte{
+		"empty":        {},
+		"not matroska": ebmlBytes(mkvSegmentId),
+		"truncated":    data[:len(data)-3],
+		"no segment":   ebmlBytes(ebmlHeaderId, ebmlString(ebmlDocTypeId, "matroska")),
+		"doc type":     ebmlBytes(ebmlHeaderId, ebmlString(ebmlDocTypeId, "avi")),
+	}
+
+	for name, test := range tests {
+		if _, err := parseMatroska(bytes.NewReader(test), int64(len(test))); err == nil {
+			t.Errorf("parseMatroska() of %v succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/drone/routes"
+	"github.com/sharkone/libtorrent-go"
+)
+
+const (
+	fileSkipped        = 0
+	fileNormalPriority = 1
+	fileMaxPriority    = 7
+
+	// Pieces read out of the streaming order, ex: embedded subtitles
+	backgroundPiecePriority = 4
+
+	filePolicyAll      = "all"
+	filePolicyStreamed = "streamed"
+)
+
+// sidecarExtensions are downloaded along with the streamed file.
+var sidecarExtensions = map[string]bool{
+	".srt": true,
+	".sub": true,
+	".idx": true,
+	".ass": true,
+	".ssa": true,
+	".vtt": true,
+	".smi": true,
+	".nfo": true,
+}
+
+var errNoMetadata = errors.New("Torrent metadata not received yet")
+
+// getSidecarIndices returns the files going along with the video, named or
+// stored like its subtitles, see matchSubtitle.
+func getSidecarIndices(videoPath string, filePaths []string) []int {
+	videoDir := path.Dir(videoPath)
+	videoCount := 0
+	for _, filePath := range filePaths {
+		if isVideo(filePath) && path.Dir(filePath) == videoDir {
+			videoCount++
+		}
+	}
+
+	result := make([]int, 0)
+	for index, filePath := range filePaths {
+		if !sidecarExtensions[strings.ToLower(path.Ext(filePath))] {
+			continue
+		}
+		if _, ok := matchSubtitle(videoPath, filePath, videoCount <= 1); ok {
+			result = append(result, index)
+		}
+	}
+	return result
+}
+
+// FilePriorities holds the priority of each file of a torrent. Priorities set
+// through the API override the download policy and are kept on restart.
+type FilePriorities struct {
+	mutex      sync.Mutex
+	priorities []int
+	overrides  map[int]int
+	sidecars   map[int][]int
+}
+
+func NewFilePriorities(overrides map[int]int) *FilePriorities {
+	result := &FilePriorities{overrides: make(map[int]int), sidecars: make(map[int][]int)}
+	for index, priority := range overrides {
+		result.overrides[index] = priority
+	}
+	return result
+}
+
+// reset returns the priorities to hand to libtorrent.
+func (fp *FilePriorities) reset(defaults []int) []int {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+
+	fp.priorities = defaults
+	for index, priority := range fp.overrides {
+		if index < len(fp.priorities) {
+			fp.priorities[index] = priority
+		}
+	}
+	return append([]int(nil), fp.priorities...)
+}
+
+// override returns nil until the policy was applied.
+func (fp *FilePriorities) override(priorities map[int]int) ([]int, map[int]int) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+
+	if fp.priorities == nil {
+		return nil, nil
+	}
+	for index, priority := range priorities {
+		fp.overrides[index] = priority
+		fp.priorities[index] = priority
+	}
+
+	overrides := make(map[int]int, len(fp.overrides))
+	for index, priority := range fp.overrides {
+		overrides[index] = priority
+	}
+	return append([]int(nil), fp.priorities...), overrides
+}
+
+// want makes sure skipped files get downloaded, unless skipped through the
+// API. Nil is returned when nothing changed.
+func (fp *FilePriorities) want(indices []int) []int {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+
+	changed := false
+	for _, index := range indices {
+		if _, ok := fp.overrides[index]; ok || index >= len(fp.priorities) {
+			continue
+		}
+		if fp.priorities[index] == fileSkipped {
+			fp.priorities[index] = fileNormalPriority
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return append([]int(nil), fp.priorities...)
+}
+
+// getSidecars only calls find once per video.
+func (fp *FilePriorities) getSidecars(videoIndex int, find func() []int) []int {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+
+	result, ok := fp.sidecars[videoIndex]
+	if !ok {
+		result = find()
+		fp.sidecars[videoIndex] = result
+	}
+	return result
+}
+
+// get returns the normal priority until metadata is received.
+func (fp *FilePriorities) get(index int) int {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+
+	if index < len(fp.priorities) {
+		return fp.priorities[index]
+	}
+	return fileNormalPriority
+}
+
+func prioritizeFiles(handle libtorrent.Torrent_handle, priorities []int) {
+	filePriorities := libtorrent.NewStdVectorInt()
+	for _, priority := range priorities {
+		filePriorities.Add(priority)
+	}
+	handle.Prioritize_files(filePriorities)
+}
+
+// getDefaultFilePriorities applies the download policy, the magnet link file
+// selection wins over it.
+func getDefaultFilePriorities(torrentInfo *TorrentInfo, selectOnly []int, streamed *TorrentFileInfo) []int {
+	result := make([]int, len(torrentInfo.Files))
+
+	if len(selectOnly) > 0 {
+		selectedCount := 0
+		for _, index := range selectOnly {
+			if index < len(result) {
+				result[index] = fileNormalPriority
+				selectedCount++
+			}
+		}
+		if selectedCount > 0 {
+			return result
+		}
+		log.Printf("[scrapmagnet] Ignoring file selection of %v, it has %v files", torrentInfo.Name, len(result))
+	}
+
+	if settings.filePolicy != filePolicyStreamed || streamed == nil {
+		for i := range result {
+			result[i] = fileNormalPriority
+		}
+		return result
+	}
+
+	filePaths := make([]string, len(torrentInfo.Files))
+	for _, torrentFileInfo := range torrentInfo.Files {
+		filePaths[torrentFileInfo.Index] = torrentFileInfo.Path
+	}
+	result[streamed.Index] = fileNormalPriority
+	for _, index := range getSidecarIndices(streamed.Path, filePaths) {
+		result[index] = fileNormalPriority
+	}
+	return result
+}
+
+// wantTorrentFile makes sure a file being streamed is downloaded along with
+// its sidecars, even though the policy skipped them.
+func (b *BitTorrent) wantTorrentFile(torrentFileInfo *TorrentFileInfo) {
+	entry, ok := b.registry.Get(torrentFileInfo.GetInfoHashStr())
+	if !ok {
+		return
+	}
+
+	sidecars := entry.filePriorities.getSidecars(torrentFileInfo.Index, func() []int {
+		files := torrentFileInfo.handle.Torrent_file().Files()
+		filePaths := make([]string, files.Num_files())
+		for i := range filePaths {
+			filePaths[i] = files.File_path(i)
+		}
+		return getSidecarIndices(torrentFileInfo.Path, filePaths)
+	})
+	indices := append([]int{torrentFileInfo.Index}, sidecars...)
+	if priorities := entry.filePriorities.want(indices); priorities != nil {
+		prioritizeFiles(torrentFileInfo.handle, priorities)
+	}
+}
+
+// FilePriorityRule sets the priority of the file at Index, or of every file
+// matching Match, see GetTorrentFileInfosByMatch.
+type FilePriorityRule struct {
+	Index    *int   `json:"index,omitempty"`
+	Match    string `json:"match,omitempty"`
+	Priority int    `json:"priority"`
+}
+
+// SetFilePriorities applies the rules in order, so later rules win.
+func (b *BitTorrent) SetFilePriorities(infoHash string, rules []*FilePriorityRule) (*TorrentInfo, error) {
+	entry, ok := b.registry.Get(infoHash)
+	if !ok {
+		return nil, nil
+	}
+	handle, ok := b.getTorrentHandle(infoHash)
+	if !ok {
+		return nil, nil
+	}
+	torrentInfo := b.GetTorrentInfo(infoHash)
+	if torrentInfo == nil {
+		return nil, nil
+	}
+	if len(torrentInfo.Files) == 0 {
+		return nil, errNoMetadata
+	}
+
+	priorities := make(map[int]int)
+	for _, rule := range rules {
+		if rule.Priority < fileSkipped || rule.Priority > fileMaxPriority {
+			return nil, fmt.Errorf("Invalid priority %v, must be between %v and %v", rule.Priority, fileSkipped, fileMaxPriority)
+		}
+
+		switch {
+		case rule.Index != nil && rule.Match != "":
+			return nil, errors.New("Rules must have either an index or a match")
+		case rule.Index != nil:
+			if torrentInfo.GetTorrentFileInfoByIndex(*rule.Index) == nil {
+				return nil, fmt.Errorf("Invalid file index %v", *rule.Index)
+			}
+			priorities[*rule.Index] = rule.Priority
+		case rule.Match != "":
+			torrentFileInfos, err := torrentInfo.GetTorrentFileInfosByMatch(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid file match: %v", err)
+			}
+			for _, torrentFileInfo := range torrentFileInfos {
+				priorities[torrentFileInfo.Index] = rule.Priority
+			}
+		default:
+			return nil, errors.New("Rules must have either an index or a match")
+		}
+	}
+
+	filePriorities, overrides := entry.filePriorities.override(priorities)
+	if filePriorities == nil {
+		return nil, errNoMetadata
+	}
+	prioritizeFiles(handle, filePriorities)
+	b.saveFilePriorities(infoHash, overrides)
+	return b.GetTorrentInfo(infoHash), nil
+}
+
+func apiSetFilePriorities(w http.ResponseWriter, r *http.Request) {
+	rules := make([]*FilePriorityRule, 0)
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid file priorities", http.StatusBadRequest)
+		return
+	}
+
+	torrentInfo, err := httpInstance.bitTorrent.SetFilePriorities(getInfoHashParam(r), rules)
+	if err == errNoMetadata {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if torrentInfo == nil {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+	} else {
+		routes.ServeJson(w, torrentInfo.Files)
+	}
+}
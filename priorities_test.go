@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetSidecarIndices(t *testing.T) {
+	movie := []string{
+		"Movie/Movie.mkv",
+		"Movie/Movie.nfo",
+		"Movie/Movie.en.srt",
+		"Movie/Subs/English.srt",
+		"Movie/Subs/French.sub",
+		"Movie/Sample/Sample.mkv",
+		"Movie/Cover.jpg",
+	}
+	season := []string{
+		"Show/Show.S01E01.mkv",
+		"Show/Show.S01E01.srt",
+		"Show/Show.S01E02.mkv",
+		"Show/Show.S01E02.srt",
+		"Show/Show.S01E02.nfo",
+		"Show/Subs/English.srt",
+		"Show/Subs/Show.S01E01/2_English.srt",
+		"Show/Subs/Show.S01E02/2_English.srt",
+		"Show/Extras/Show.S01E01.srt",
+	}
+
+	tests := []struct {
+		videoPath string
+		filePaths []string
+		expected  []int
+	}{
+		{"Movie/Movie.mkv", movie, []int{1, 2, 3, 4}},
+		{"Show/Show.S01E01.mkv", season, []int{1, 6}},
+		{"Show/Show.S01E02.mkv", season, []int{3, 4, 7}},
+		{"Movie.mp4", []string{"Movie.mp4", "Movie.srt", "Other.srt", "Subs/English.vtt"}, []int{1, 3}},
+	}
+
+	for _, test := range tests {
+		if result := getSidecarIndices(test.videoPath, test.filePaths); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("getSidecarIndices(%q) = %v, expected %v", test.videoPath, result, test.expected)
+		}
+	}
+}
+
+func TestFilePrioritiesGetSidecars(t *testing.T) {
+	filePriorities := NewFilePriorities(nil)
+	calls := 0
+	find := func() []int {
+		calls++
+		return []int{2}
+	}
+
+	for i := 0; i < 3; i++ {
+		if result := filePriorities.getSidecars(1, find); !reflect.DeepEqual(result, []int{2}) {
+			t.Errorf("getSidecars() = %v", result)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Sidecars were found %v times, expected once", calls)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	maxStreamInfos          = 20
+	streamAheadRefreshDelay = time.Second
+)
+
+// StreamInfo measures the quality of service of one /video stream.
+type StreamInfo struct {
+	mutex sync.Mutex
+
+	id               int64
+	file             string
+	startedAt        time.Time
+	stoppedAt        time.Time
+	timeToMetadata   time.Duration
+	timeToFirstByte  time.Duration
+	rebuffers        int
+	rebufferDuration time.Duration
+	position         int64
+	aheadBytes       int64
+	aheadUpdatedAt   time.Time
+}
+
+var lastStreamID int64
+var lastStreamIDMutex sync.Mutex
+
+// NewStreamInfo is given when the request started, waiting for the metadata
+// and the file counts in the time to first byte.
+func NewStreamInfo(file string, timeToMetadata time.Duration, startedAt time.Time) *StreamInfo {
+	lastStreamIDMutex.Lock()
+	lastStreamID++
+	id := lastStreamID
+	lastStreamIDMutex.Unlock()
+
+	return &StreamInfo{
+		id:              id,
+		file:            file,
+		startedAt:       startedAt,
+		timeToMetadata:  timeToMetadata,
+		timeToFirstByte: -1,
+	}
+}
+
+func (si *StreamInfo) MarshalJSON() ([]byte, error) {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	return json.Marshal(map[string]interface{}{
+		"id":                 si.id,
+		"file":               si.file,
+		"active":             si.stoppedAt.IsZero(),
+		"started_at":         si.startedAt,
+		"time_to_metadata":   durationSeconds(si.timeToMetadata),
+		"time_to_first_byte": durationSeconds(si.timeToFirstByte),
+		"rebuffers":          si.rebuffers,
+		"rebuffer_duration":  si.rebufferDuration.Seconds(),
+		"position":           si.position,
+		"ahead_bytes":        si.aheadBytes,
+	})
+}
+
+// durationSeconds reports unmeasured (negative) durations as -1.
+func durationSeconds(duration time.Duration) float64 {
+	if duration < 0 {
+		return -1
+	}
+	return duration.Seconds()
+}
+
+// onRead returns whether it was the first read of the stream.
+func (si *StreamInfo) onRead(position int64) bool {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	si.position = position
+	if si.timeToFirstByte < 0 {
+		si.timeToFirstByte = time.Since(si.startedAt)
+		return true
+	}
+	return false
+}
+
+func (si *StreamInfo) onRebuffer(duration time.Duration) {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	si.rebuffers++
+	si.rebufferDuration += duration
+}
+
+func (si *StreamInfo) onStop() {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	si.stoppedAt = time.Now()
+}
+
+// updateAhead only recomputes the downloaded bytes ahead of the playback
+// position once in a while, as reads are far more frequent.
+func (si *StreamInfo) updateAhead(tfi *TorrentFileInfo) {
+	si.mutex.Lock()
+	if time.Since(si.aheadUpdatedAt) < streamAheadRefreshDelay {
+		si.mutex.Unlock()
+		return
+	}
+	si.aheadUpdatedAt = time.Now()
+	position := si.position
+	si.mutex.Unlock()
+
+	aheadBytes := tfi.GetAheadBytes(position)
+
+	si.mutex.Lock()
+	si.aheadBytes = aheadBytes
+	si.mutex.Unlock()
+}
+
+func (tci *TorrentConnectionInfo) AddStream(streamInfo *StreamInfo) {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	// Drop the oldest stopped streams first
+	if len(tci.streams) >= maxStreamInfos {
+		for i, oldStreamInfo := range tci.streams {
+			oldStreamInfo.mutex.Lock()
+			stopped := !oldStreamInfo.stoppedAt.IsZero()
+			oldStreamInfo.mutex.Unlock()
+			if stopped {
+				tci.streams = append(tci.streams[:i], tci.streams[i+1:]...)
+				break
+			}
+		}
+	}
+	tci.streams = append(tci.streams, streamInfo)
+}
+
+func (tci *TorrentConnectionInfo) GetStreams() []*StreamInfo {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	return append([]*StreamInfo{}, tci.streams...)
+}
+
+func (tci *TorrentConnectionInfo) GetTimeToMetadata() time.Duration {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	if tci.metadataAt.IsZero() {
+		return -1
+	}
+	return tci.metadataAt.Sub(tci.addedAt)
+}
+
+func (tci *TorrentConnectionInfo) onMetadata() {
+	tci.mutex.Lock()
+	defer tci.mutex.Unlock()
+
+	if tci.metadataAt.IsZero() {
+		tci.metadataAt = time.Now()
+	}
+}
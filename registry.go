@@ -0,0 +1,349 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type TorrentState int
+
+const (
+	TorrentAdding TorrentState = iota
+	TorrentMetadata
+	TorrentReady
+	TorrentPaused
+	TorrentRemoving
+	TorrentRemoved
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case TorrentAdding:
+		return "adding"
+	case TorrentMetadata:
+		return "metadata"
+	case TorrentReady:
+		return "ready"
+	case TorrentPaused:
+		return "paused"
+	case TorrentRemoving:
+		return "removing"
+	case TorrentRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// torrentTransitions lists the states each state can move to. Torrents are
+// only removed without going through removing when libtorrent fails to add
+// them.
+var torrentTransitions = map[TorrentState][]TorrentState{
+	TorrentAdding:   {TorrentMetadata, TorrentReady, TorrentRemoving, TorrentRemoved},
+	TorrentMetadata: {TorrentReady, TorrentPaused, TorrentRemoving},
+	TorrentReady:    {TorrentPaused, TorrentRemoving},
+	TorrentPaused:   {TorrentMetadata, TorrentReady, TorrentRemoving},
+	TorrentRemoving: {TorrentRemoved},
+}
+
+func canTransition(from TorrentState, to TorrentState) bool {
+	for _, state := range torrentTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// torrentEntry holds what scrapmagnet tracks about a torrent. Fields set on
+// creation never change, the others are guarded by the registry mutex.
+type torrentEntry struct {
+	infoHash       string
+	magnet         *Magnet
+	lookAhead      float32
+	mixpanelData   string
+	connectionInfo *TorrentConnectionInfo
+	errors         *ErrorLog
+	filePriorities *FilePriorities
+	activity       *TorrentActivity
+	connectionChan chan int
+	doneChan       chan bool
+
+	state        TorrentState
+	hasMetadata  bool
+	deleteFiles  bool
+	fileSelector *TorrentFileSelector
+}
+
+// TorrentRegistry is the only place torrents are tracked, it is shared by the
+// HTTP handlers, the alert pump and the inactivity watchers.
+type TorrentRegistry struct {
+	mutex    sync.Mutex
+	entries  map[string]*torrentEntry
+	failures map[string]*TorrentError
+}
+
+func NewTorrentRegistry() *TorrentRegistry {
+	return &TorrentRegistry{
+		entries:  make(map[string]*torrentEntry),
+		failures: make(map[string]*TorrentError),
+	}
+}
+
+// Add registers a torrent about to be added to the session. A torrent
+// already registered keeps its settings and nil is returned. While it is
+// being removed, waitChan is closed once it is gone so it can be added again.
+func (tr *TorrentRegistry) Add(infoHash string, magnet *Magnet, lookAhead float32, fileSelector *TorrentFileSelector, filePriorities map[int]int, mixpanelData string) (entry *torrentEntry, waitChan chan bool) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if existing, ok := tr.entries[infoHash]; ok {
+		if existing.state >= TorrentRemoving {
+			return nil, existing.doneChan
+		}
+		return nil, nil
+	}
+
+	entry = &torrentEntry{
+		infoHash:       infoHash,
+		magnet:         magnet,
+		lookAhead:      lookAhead,
+		fileSelector:   fileSelector,
+		mixpanelData:   mixpanelData,
+		connectionInfo: NewTorrentConnectionInfo(),
+		errors:         NewErrorLog(),
+		filePriorities: NewFilePriorities(filePriorities),
+		activity:       NewTorrentActivity(),
+		connectionChan: make(chan int),
+		doneChan:       make(chan bool),
+		state:          TorrentAdding,
+	}
+	tr.entries[infoHash] = entry
+	return entry, nil
+}
+
+// SetFileSelector returns false when the torrent is unknown, being removed or
+// already selects files that way.
+func (tr *TorrentRegistry) SetFileSelector(infoHash string, fileSelector *TorrentFileSelector) bool {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	entry, ok := tr.entries[infoHash]
+	if !ok || entry.state >= TorrentRemoving || (entry.fileSelector != nil && *entry.fileSelector == *fileSelector) {
+		return false
+	}
+	entry.fileSelector = fileSelector
+	return true
+}
+
+func (tr *TorrentRegistry) GetFileSelector(entry *torrentEntry) *TorrentFileSelector {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return entry.fileSelector
+}
+
+// Get returns torrents which are not being removed.
+func (tr *TorrentRegistry) Get(infoHash string) (*torrentEntry, bool) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	entry, ok := tr.entries[infoHash]
+	if !ok || entry.state >= TorrentRemoving {
+		return nil, false
+	}
+	return entry, true
+}
+
+// Lookup also returns torrents being removed.
+func (tr *TorrentRegistry) Lookup(infoHash string) (*torrentEntry, bool) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	entry, ok := tr.entries[infoHash]
+	return entry, ok
+}
+
+func (tr *TorrentRegistry) GetState(infoHash string) (TorrentState, bool) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if entry, ok := tr.entries[infoHash]; ok {
+		return entry.state, true
+	}
+	return TorrentRemoved, false
+}
+
+// IsActive tells whether libtorrent acknowledged the torrent and it is not
+// being removed.
+func (tr *TorrentRegistry) IsActive(infoHash string) bool {
+	state, ok := tr.GetState(infoHash)
+	return ok && state > TorrentAdding && state < TorrentRemoving
+}
+
+// Transition returns false when the torrent is unknown, already in that
+// state, or can't move to it.
+func (tr *TorrentRegistry) Transition(infoHash string, to TorrentState) bool {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	entry, ok := tr.entries[infoHash]
+	return ok && tr.setState(entry, to)
+}
+
+// setState is called with the mutex held, every state change goes through it.
+func (tr *TorrentRegistry) setState(entry *torrentEntry, to TorrentState) bool {
+	if !canTransition(entry.state, to) {
+		return false
+	}
+	entry.state = to
+	return true
+}
+
+func (tr *TorrentRegistry) OnAdded(infoHash string, hasMetadata bool) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if entry, ok := tr.entries[infoHash]; ok && entry.state == TorrentAdding {
+		entry.hasMetadata = hasMetadata
+		if hasMetadata {
+			tr.setState(entry, TorrentReady)
+		} else {
+			tr.setState(entry, TorrentMetadata)
+		}
+	}
+}
+
+// OnMetadata keeps paused torrents paused, they are ready once resumed.
+func (tr *TorrentRegistry) OnMetadata(infoHash string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if entry, ok := tr.entries[infoHash]; ok {
+		entry.hasMetadata = true
+		if entry.state == TorrentMetadata {
+			tr.setState(entry, TorrentReady)
+		}
+	}
+}
+
+func (tr *TorrentRegistry) OnResumed(infoHash string) bool {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	entry, ok := tr.entries[infoHash]
+	if !ok || entry.state != TorrentPaused {
+		return false
+	}
+	if entry.hasMetadata {
+		return tr.setState(entry, TorrentReady)
+	}
+	return tr.setState(entry, TorrentMetadata)
+}
+
+// BeginRemove moves the torrent to removing and tells whether the caller is
+// the first, which should ask libtorrent to remove it, and whether files are
+// deleted. Later callers just wait on the entry doneChan, files are only
+// deleted when the first caller asked.
+func (tr *TorrentRegistry) BeginRemove(infoHash string, deleteFiles bool) (*torrentEntry, bool, bool) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	entry, ok := tr.entries[infoHash]
+	if !ok {
+		return nil, false, false
+	}
+	if entry.state >= TorrentRemoving {
+		return entry, false, entry.deleteFiles
+	}
+
+	// Without metadata there are no files, nor any deletion alert
+	tr.setState(entry, TorrentRemoving)
+	entry.deleteFiles = deleteFiles && entry.hasMetadata
+	return entry, true, entry.deleteFiles
+}
+
+// OnRemoved is called once libtorrent removed the torrent. When its files
+// are being deleted the entry lives until OnDeleted.
+func (tr *TorrentRegistry) OnRemoved(infoHash string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if entry, ok := tr.entries[infoHash]; ok {
+		if tr.remove(entry) && !entry.deleteFiles {
+			tr.finish(entry)
+		}
+	}
+}
+
+func (tr *TorrentRegistry) OnDeleted(infoHash string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if entry, ok := tr.entries[infoHash]; ok {
+		switch entry.state {
+		case TorrentRemoving:
+			// Deleted before the removal alert was handled
+			entry.deleteFiles = false
+		case TorrentRemoved:
+			tr.finish(entry)
+		}
+	}
+}
+
+// OnAddFailed drops a torrent libtorrent rejected, the failure is remembered
+// for a while so clients stop waiting for it.
+func (tr *TorrentRegistry) OnAddFailed(infoHash string, torrentError *TorrentError) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	for failedInfoHash, failure := range tr.failures {
+		if time.Since(failure.Time) > addFailureTTL {
+			delete(tr.failures, failedInfoHash)
+		}
+	}
+	tr.failures[infoHash] = torrentError
+	if entry, ok := tr.entries[infoHash]; ok && tr.setState(entry, TorrentRemoved) {
+		tr.finish(entry)
+	}
+}
+
+func (tr *TorrentRegistry) GetAddFailure(infoHash string) *TorrentError {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	torrentError, ok := tr.failures[infoHash]
+	if !ok {
+		return nil
+	}
+	if time.Since(torrentError.Time) > addFailureTTL {
+		delete(tr.failures, infoHash)
+		return nil
+	}
+	return torrentError
+}
+
+// Forget drops a torrent libtorrent will never report about again.
+func (tr *TorrentRegistry) Forget(entry *torrentEntry) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.remove(entry)
+	if tr.entries[entry.infoHash] == entry {
+		tr.finish(entry)
+	}
+}
+
+// remove moves the entry to removed, through removing when libtorrent removed
+// the torrent on its own. It is called with the mutex held.
+func (tr *TorrentRegistry) remove(entry *torrentEntry) bool {
+	if entry.state < TorrentRemoving {
+		tr.setState(entry, TorrentRemoving)
+	}
+	return tr.setState(entry, TorrentRemoved)
+}
+
+// finish is called with the mutex held.
+func (tr *TorrentRegistry) finish(entry *torrentEntry) {
+	delete(tr.entries, entry.infoHash)
+	close(entry.doneChan)
+}
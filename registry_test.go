@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run these with -race: the registry is shared by the HTTP handlers, the alert
+// pump and the inactivity watchers.
+
+const testInfoHash = "0123456789ABCDEF0123456789ABCDEF01234567"
+
+func isClosed(doneChan chan bool) bool {
+	select {
+	case <-doneChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from     TorrentState
+		to       TorrentState
+		expected bool
+	}{
+		{TorrentAdding, TorrentMetadata, true},
+		{TorrentAdding, TorrentRemoved, true},
+		{TorrentMetadata, TorrentReady, true},
+		{TorrentReady, TorrentPaused, true},
+		{TorrentPaused, TorrentReady, true},
+		{TorrentReady, TorrentRemoving, true},
+		{TorrentRemoving, TorrentRemoved, true},
+		{TorrentReady, TorrentAdding, false},
+		{TorrentReady, TorrentRemoved, false},
+		{TorrentPaused, TorrentPaused, false},
+		{TorrentRemoving, TorrentReady, false},
+		{TorrentRemoved, TorrentAdding, false},
+	}
+
+	for _, test := range tests {
+		if result := canTransition(test.from, test.to); result != test.expected {
+			t.Errorf("canTransition(%v, %v) = %v, expected %v", test.from, test.to, result, test.expected)
+		}
+	}
+}
+
+func TestTorrentRegistryLifecycle(t *testing.T) {
+	tr := NewTorrentRegistry()
+
+	entry, waitChan := tr.Add(testInfoHash, nil, 0.005, nil, nil, "")
+	if entry == nil || waitChan != nil {
+		t.Fatalf("Add() = %v, %v, expected a new entry", entry, waitChan)
+	}
+	if existing, waitChan := tr.Add(testInfoHash, nil, 0.005, nil, nil, ""); existing != nil || waitChan != nil {
+		t.Fatalf("Add() of an added torrent = %v, %v, expected nothing", existing, waitChan)
+	}
+	if tr.IsActive(testInfoHash) {
+		t.Error("Torrent active before libtorrent added it")
+	}
+
+	tr.OnAdded(testInfoHash, false)
+	expectState(t, tr, TorrentMetadata)
+	if !tr.IsActive(testInfoHash) {
+		t.Error("Torrent not active once added")
+	}
+
+	tr.OnMetadata(testInfoHash)
+	expectState(t, tr, TorrentReady)
+
+	if !tr.Transition(testInfoHash, TorrentPaused) || tr.Transition(testInfoHash, TorrentPaused) {
+		t.Error("Transition() to paused must only succeed once")
+	}
+	if tr.Transition(testInfoHash, TorrentAdding) {
+		t.Error("Transition() back to adding succeeded")
+	}
+	if !tr.OnResumed(testInfoHash) || tr.OnResumed(testInfoHash) {
+		t.Error("OnResumed() must only succeed while paused")
+	}
+	expectState(t, tr, TorrentReady)
+
+	removing, first, deleteFiles := tr.BeginRemove(testInfoHash, false)
+	if removing != entry || !first || deleteFiles {
+		t.Fatalf("BeginRemove() = %v, %v, %v", removing, first, deleteFiles)
+	}
+	if _, first, _ := tr.BeginRemove(testInfoHash, true); first {
+		t.Error("Second BeginRemove() was told it is the first")
+	}
+	if _, ok := tr.Get(testInfoHash); ok {
+		t.Error("Get() returned a torrent being removed")
+	}
+	if _, waitChan := tr.Add(testInfoHash, nil, 0.005, nil, nil, ""); waitChan != entry.doneChan {
+		t.Error("Add() of a torrent being removed must wait for it")
+	}
+
+	tr.OnRemoved(testInfoHash)
+	if !isClosed(entry.doneChan) {
+		t.Error("Entry not done once removed")
+	}
+	if _, ok := tr.Lookup(testInfoHash); ok {
+		t.Error("Lookup() returned a removed torrent")
+	}
+}
+
+func TestTorrentRegistryDeleteFiles(t *testing.T) {
+	tr := NewTorrentRegistry()
+	entry, _ := tr.Add(testInfoHash, nil, 0.005, nil, nil, "")
+	tr.OnAdded(testInfoHash, true)
+
+	if _, _, deleteFiles := tr.BeginRemove(testInfoHash, true); !deleteFiles {
+		t.Fatal("BeginRemove() of a torrent with metadata must delete its files")
+	}
+	tr.OnRemoved(testInfoHash)
+	if isClosed(entry.doneChan) {
+		t.Fatal("Entry done before its files were deleted")
+	}
+	tr.OnDeleted(testInfoHash)
+	if !isClosed(entry.doneChan) {
+		t.Error("Entry not done once its files were deleted")
+	}
+}
+
+func TestTorrentRegistryRemovedWithoutBeginRemove(t *testing.T) {
+	tr := NewTorrentRegistry()
+	entry, _ := tr.Add(testInfoHash, nil, 0.005, nil, nil, "")
+	tr.OnAdded(testInfoHash, true)
+
+	tr.OnRemoved(testInfoHash)
+	if !isClosed(entry.doneChan) || entry.state != TorrentRemoved {
+		t.Errorf("Entry in state %v after libtorrent removed it", entry.state)
+	}
+}
+
+func TestTorrentRegistryAddFailed(t *testing.T) {
+	tr := NewTorrentRegistry()
+	entry, _ := tr.Add(testInfoHash, nil, 0.005, nil, nil, "")
+
+	tr.OnAddFailed(testInfoHash, &TorrentError{Time: time.Now(), Source: "add", InfoHash: testInfoHash, Message: "invalid"})
+	if !isClosed(entry.doneChan) {
+		t.Error("Entry not done once libtorrent rejected it")
+	}
+	if tr.GetAddFailure(testInfoHash) == nil {
+		t.Error("GetAddFailure() forgot the failure")
+	}
+
+	tr.OnAddFailed("OTHER", &TorrentError{Time: time.Now().Add(-2 * addFailureTTL), InfoHash: "OTHER"})
+	if tr.GetAddFailure("OTHER") != nil {
+		t.Error("GetAddFailure() returned an expired failure")
+	}
+
+	tr.OnAddFailed("STALE", &TorrentError{Time: time.Now().Add(-2 * addFailureTTL), InfoHash: "STALE"})
+	tr.OnAddFailed("LATEST", &TorrentError{Time: time.Now(), InfoHash: "LATEST"})
+	if _, ok := tr.failures["STALE"]; ok {
+		t.Error("OnAddFailed() kept an expired failure")
+	}
+}
+
+func expectState(t *testing.T, tr *TorrentRegistry, expected TorrentState) {
+	if state, _ := tr.GetState(testInfoHash); state != expected {
+		t.Errorf("State is %v, expected %v", state, expected)
+	}
+}
+
+// TestTorrentRegistryConcurrent races the callers of each torrent, entries
+// must be finished exactly once and always end up removed.
+func TestTorrentRegistryConcurrent(t *testing.T) {
+	tr := NewTorrentRegistry()
+
+	for round := 0; round < 20; round++ {
+		entries := make([]*torrentEntry, 0)
+		for i := 0; i < 8; i++ {
+			infoHash := fmt.Sprintf("%040X", round*8+i)
+			entry, _ := tr.Add(infoHash, nil, 0.005, nil, nil, "")
+			entries = append(entries, entry)
+		}
+
+		var wg sync.WaitGroup
+		for _, entry := range entries {
+			infoHash := entry.infoHash
+			for _, action := range []func(){
+				func() { tr.OnAdded(infoHash, false) },
+				func() { tr.OnMetadata(infoHash) },
+				func() { tr.Transition(infoHash, TorrentPaused) },
+				func() { tr.OnResumed(infoHash) },
+				func() { tr.SetFileSelector(infoHash, NewTorrentFileSelector(1, "", "")) },
+				func() { tr.IsActive(infoHash) },
+				func() { tr.Get(infoHash) },
+				func() { tr.Add(infoHash, nil, 0.005, nil, nil, "") },
+				func() { tr.BeginRemove(infoHash, true) },
+				func() { tr.BeginRemove(infoHash, false) },
+				func() { tr.OnRemoved(infoHash) },
+				func() { tr.OnDeleted(infoHash) },
+			} {
+				wg.Add(1)
+				go func(action func()) {
+					defer wg.Done()
+					action()
+				}(action)
+			}
+		}
+		wg.Wait()
+
+		for _, entry := range entries {
+			if _, ok := tr.Lookup(entry.infoHash); ok {
+				tr.Forget(entry)
+			}
+			if !isClosed(entry.doneChan) {
+				t.Fatalf("Entry %v not done", entry.infoHash)
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sharkone/libtorrent-go"
+)
+
+const resumeDataStopTimeout = 10 * time.Second
+
+// TorrentResumeInfo holds what libtorrent resume data doesn't: how the
+// torrent was added and the client settings attached to it.
+type TorrentResumeInfo struct {
+	MagnetLink     string               `json:"magnet_link,omitempty"`
+	DownloadDir    string               `json:"download_dir"`
+	LookAhead      float32              `json:"look_ahead"`
+	FileSelector   *TorrentFileSelector `json:"file_selector,omitempty"`
+	FilePriorities map[int]int          `json:"file_priorities,omitempty"`
+	MixpanelData   string               `json:"mixpanel_data,omitempty"`
+}
+
+func getResumeFilePath(infoHash string, extension string) string {
+	return filepath.Join(settings.stateDir, infoHash+extension)
+}
+
+// writeFileAtomic first removes a temporary file left by a crash, writing
+// over it would keep its mode.
+func writeFileAtomic(filePath string, data []byte, mode os.FileMode) error {
+	tmpPath := filePath + ".tmp"
+	os.Remove(tmpPath)
+	if err := ioutil.WriteFile(tmpPath, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+// saveResumeInfo is called when a torrent is added, torrentData is nil for
+// magnet links. Existing resume info is kept so restored torrents keep theirs.
+func (b *BitTorrent) saveResumeInfo(infoHash string, resumeInfo *TorrentResumeInfo, torrentData []byte) {
+	if settings.stateDir == "" {
+		return
+	}
+
+	resumeInfoPath := getResumeFilePath(infoHash, ".json")
+	if _, err := os.Stat(resumeInfoPath); err == nil {
+		return
+	}
+
+	if err := os.MkdirAll(settings.stateDir, 0755); err != nil {
+		log.Print(err)
+		return
+	}
+
+	if torrentData != nil {
+		if err := writeFileAtomic(getResumeFilePath(infoHash, ".torrent"), torrentData, 0644); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if data, err := json.Marshal(resumeInfo); err == nil {
+		if err := writeFileAtomic(resumeInfoPath, data, 0644); err != nil {
+			log.Print(err)
+		}
+	} else {
+		log.Print(err)
+	}
+}
+
+// updateResumeInfo rewrites the resume info saved when the torrent was added.
+func (b *BitTorrent) updateResumeInfo(infoHash string, update func(resumeInfo *TorrentResumeInfo)) {
+	if settings.stateDir == "" {
+		return
+	}
+
+	resumeInfoPath := getResumeFilePath(infoHash, ".json")
+	data, err := ioutil.ReadFile(resumeInfoPath)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	resumeInfo := &TorrentResumeInfo{}
+	if err := json.Unmarshal(data, resumeInfo); err != nil {
+		log.Print(err)
+		return
+	}
+
+	update(resumeInfo)
+	if data, err = json.Marshal(resumeInfo); err == nil {
+		if err := writeFileAtomic(resumeInfoPath, data, 0644); err != nil {
+			log.Print(err)
+		}
+	} else {
+		log.Print(err)
+	}
+}
+
+// saveFilePriorities updates the resume info with the priorities set through
+// the API.
+func (b *BitTorrent) saveFilePriorities(infoHash string, filePriorities map[int]int) {
+	b.updateResumeInfo(infoHash, func(resumeInfo *TorrentResumeInfo) {
+		resumeInfo.FilePriorities = filePriorities
+	})
+}
+
+func (b *BitTorrent) saveFileSelector(infoHash string, fileSelector *TorrentFileSelector) {
+	b.updateResumeInfo(infoHash, func(resumeInfo *TorrentResumeInfo) {
+		resumeInfo.FileSelector = fileSelector
+	})
+}
+
+func (b *BitTorrent) deleteResumeInfo(infoHash string) {
+	if settings.stateDir == "" {
+		return
+	}
+
+	for _, extension := range []string{".json", ".torrent", ".fastresume"} {
+		if err := os.Remove(getResumeFilePath(infoHash, extension)); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+}
+
+func (b *BitTorrent) loadResumeInfos() {
+	if settings.stateDir == "" {
+		return
+	}
+
+	resumeInfoPaths, err := filepath.Glob(filepath.Join(settings.stateDir, "*.json"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, resumeInfoPath := range resumeInfoPaths {
+		infoHash := strings.TrimSuffix(filepath.Base(resumeInfoPath), ".json")
+		if err := b.loadResumeInfo(infoHash); err != nil {
+			log.Printf("[scrapmagnet] Failed to restore %v: %v", infoHash, err)
+		}
+	}
+}
+
+func (b *BitTorrent) loadResumeInfo(infoHash string) error {
+	data, err := ioutil.ReadFile(getResumeFilePath(infoHash, ".json"))
+	if err != nil {
+		return err
+	}
+
+	resumeInfo := &TorrentResumeInfo{}
+	if err := json.Unmarshal(data, resumeInfo); err != nil {
+		return err
+	}
+
+	// The storage root may have changed since the torrent was added
+	downloadDir, err := resolveStoragePath(resumeInfo.DownloadDir)
+	if err != nil {
+		return err
+	}
+
+	addTorrentParams := libtorrent.NewAdd_torrent_params()
+
+	var magnet *Magnet
+	if resumeInfo.MagnetLink != "" {
+		if magnet, err = ParseMagnet(resumeInfo.MagnetLink); err != nil {
+			return err
+		}
+		magnet.setAddTorrentParams(addTorrentParams)
+	}
+
+	resumeData, _ := ioutil.ReadFile(getResumeFilePath(infoHash, ".fastresume"))
+	if len(resumeData) > 0 {
+		resumeDataVector := libtorrent.NewStdVectorChar()
+		for _, c := range resumeData {
+			resumeDataVector.Add(c)
+		}
+		addTorrentParams.SetResume_data(resumeDataVector)
+	}
+
+	// Resume data saved after the metadata was received embeds the info
+	// dictionary, so magnet links don't have to fetch it again
+	torrentData, _ := ioutil.ReadFile(getResumeFilePath(infoHash, ".torrent"))
+	if torrentData == nil && len(resumeData) > 0 {
+		if info, err := getTorrentFileInfoDict(resumeData); err == nil {
+			torrentData = append(append([]byte("d4:info"), info...), 'e')
+		}
+	}
+
+	if torrentData != nil {
+		if torrentInfo, err := newTorrentInfo(torrentData); err == nil {
+			addTorrentParams.SetTi(torrentInfo)
+		} else if magnet == nil {
+			return err
+		}
+	} else if torrentInfo := loadCachedMetadata(infoHash); torrentInfo != nil {
+		addTorrentParams.SetTi(torrentInfo)
+	} else if magnet == nil {
+		return errors.New("Missing torrent file")
+	}
+
+	log.Printf("[scrapmagnet] Restoring %v", infoHash)
+	b.addTorrent(addTorrentParams, downloadDir, infoHash, magnet, resumeInfo.LookAhead, resumeInfo.FileSelector, resumeInfo.FilePriorities, resumeInfo.MixpanelData)
+	return nil
+}
+
+// resumeDataPump periodically asks libtorrent for the resume data of
+// torrents that changed since the last save.
+func (b *BitTorrent) resumeDataPump() {
+	for range time.Tick(time.Duration(settings.resumeDataInterval) * time.Second) {
+		handles := b.session.Get_torrents()
+		for i := 0; i < int(handles.Size()); i++ {
+			handle := handles.Get(i)
+			if handle.Torrent_file().Swigcptr() != 0 && handle.Need_save_resume_data() {
+				handle.Save_resume_data(int(libtorrent.Torrent_handleSave_info_dict))
+			}
+		}
+	}
+}
+
+// saveAllResumeData requests the resume data of every torrent and waits for
+// it to be written, so nothing is lost when the session stops.
+func (b *BitTorrent) saveAllResumeData() {
+	pending := 0
+	handles := b.session.Get_torrents()
+	resumeDataChan := make(chan bool, handles.Size())
+	b.mutex.Lock()
+	b.resumeDataChan = resumeDataChan
+	b.mutex.Unlock()
+	for i := 0; i < int(handles.Size()); i++ {
+		handle := handles.Get(i)
+		if handle.Torrent_file().Swigcptr() != 0 {
+			handle.Save_resume_data(int(libtorrent.Torrent_handleSave_info_dict))
+			pending++
+		}
+	}
+
+	timeout := time.After(resumeDataStopTimeout)
+	for ; pending > 0; pending-- {
+		select {
+		case <-resumeDataChan:
+		case <-timeout:
+			log.Printf("[scrapmagnet] Timed out saving resume data, %v left", pending)
+			return
+		}
+	}
+}
+
+func (b *BitTorrent) onSaveResumeData(handle libtorrent.Torrent_handle, resumeData libtorrent.Entry) {
+	infoHash := b.getTorrentInfoHash(handle)
+	if err := writeFileAtomic(getResumeFilePath(infoHash, ".fastresume"), []byte(libtorrent.Bencode(resumeData)), 0644); err != nil {
+		log.Print(err)
+	}
+	b.onResumeDataDone()
+}
+
+func (b *BitTorrent) onResumeDataDone() {
+	b.mutex.Lock()
+	resumeDataChan := b.resumeDataChan
+	b.mutex.Unlock()
+
+	if resumeDataChan != nil {
+		select {
+		case resumeDataChan <- true:
+		default:
+		}
+	}
+}
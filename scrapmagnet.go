@@ -3,23 +3,50 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 )
 
 type Settings struct {
 	parentPID               int
 	httpPort                int
+	httpBind                string
+	tlsCert                 string
+	tlsKey                  string
+	tlsSelfSigned           bool
+	adminTokens             string
+	viewerTokens            string
 	bitTorrentPort          int
 	uPNPNatPMPEnabled       bool
 	maxDownloadRate         int
 	maxUploadRate           int
 	keepFiles               bool
+	storageRoot             string
 	inactivityPauseTimeout  int
 	inactivityRemoveTimeout int
+	pieceWaitTimeout        int
+	videoNotReadyMode       string
+	filePolicy              string
+	qosEvents               bool
+	stateDir                string
+	resumeDataInterval      int
+	metadataCacheDir        string
+	metadataCacheSize       int
 	proxyType               string
 	proxyHost               string
 	proxyPort               int
 	proxyUser               string
 	proxyPassword           string
+	telemetry               string
+	telemetryFile           string
+	telemetryURL            string
+	webhookURLs             string
+	webhookSecret           string
+	onAdded                 string
+	onMetadata              string
+	onFinished              string
+	onRemoved               string
+	hookTimeout             int
+	hookConcurrency         int
 	mixpanelToken           string
 	mixpanelData            string
 }
@@ -33,29 +60,74 @@ var (
 func main() {
 	flag.IntVar(&settings.parentPID, "ppid", -1, "Parent PID to monitor and auto-shutdown")
 	flag.IntVar(&settings.httpPort, "http-port", 8042, "Port used for HTTP server")
+	flag.StringVar(&settings.httpBind, "http-bind", "", "Comma separated HTTP listen addresses (ex: 127.0.0.1,[::1]:8043,unix:/tmp/scrapmagnet.sock), empty = 0.0.0.0:<http-port>")
+	flag.StringVar(&settings.tlsCert, "tls-cert", "", "TLS certificate file used for TCP listeners")
+	flag.StringVar(&settings.tlsKey, "tls-key", "", "TLS key file used for TCP listeners")
+	flag.BoolVar(&settings.tlsSelfSigned, "tls-self-signed", false, "Use a self-signed certificate persisted in the state directory for TCP listeners")
+	flag.StringVar(&settings.adminTokens, "admin-tokens", os.Getenv("SCRAPMAGNET_ADMIN_TOKENS"), "Comma separated API tokens allowed to do anything, empty = No authentication")
+	flag.StringVar(&settings.viewerTokens, "viewer-tokens", os.Getenv("SCRAPMAGNET_VIEWER_TOKENS"), "Comma separated API tokens only allowed to read and stream")
 	flag.IntVar(&settings.bitTorrentPort, "bittorrent-port", 6900, "Port used for BitTorrent incoming connections")
 	flag.BoolVar(&settings.uPNPNatPMPEnabled, "upnp-natpmp-enabled", true, "Enable UPNP/NATPMP")
 	flag.IntVar(&settings.maxDownloadRate, "max-download-rate", 0, "Maximum download rate in kB/s, 0 = Unlimited")
 	flag.IntVar(&settings.maxUploadRate, "max-upload-rate", 0, "Maximum upload rate in kB/s, 0 = Unlimited")
 	flag.BoolVar(&settings.keepFiles, "keep-files", false, "Keep downloaded files upon stopping")
+	flag.StringVar(&settings.storageRoot, "storage-root", "", "Download directories and torrent_path are restricted to this directory, empty = Unrestricted and torrent_path disabled")
 	flag.IntVar(&settings.inactivityPauseTimeout, "inactivity-pause-timeout", 4, "Torrents will be paused after some inactivity")
 	flag.IntVar(&settings.inactivityRemoveTimeout, "inactivity-remove-timeout", 600, "Torrents will be removed after some inactivity")
+	flag.IntVar(&settings.pieceWaitTimeout, "piece-wait-timeout", 0, "Streams will fail after waiting this long for a piece, 0 = Unlimited")
+	flag.StringVar(&settings.videoNotReadyMode, "video-not-ready", "redirect", "Response while a video is not ready: redirect/accepted")
+	flag.StringVar(&settings.filePolicy, "file-policy", filePolicyStreamed, "Files downloaded once metadata is received: streamed (streamed file and its subtitles) or all")
+	flag.BoolVar(&settings.qosEvents, "qos-events", false, "Publish stream quality of service measurements on /events")
+	flag.StringVar(&settings.stateDir, "state-dir", "", "Directory where torrents are saved to be restored on restart, empty = Disabled")
+	flag.IntVar(&settings.resumeDataInterval, "resume-data-interval", 60, "Resume data is saved periodically, 0 = Only on shutdown")
+	flag.StringVar(&settings.metadataCacheDir, "metadata-cache-dir", "", "Directory where torrent metadata is cached, empty = Disabled")
+	flag.IntVar(&settings.metadataCacheSize, "metadata-cache-size", 50, "Maximum metadata cache size in MB, 0 = Unlimited")
 	flag.StringVar(&settings.proxyType, "proxy-type", "None", "Proxy type: None/SOCKS5")
 	flag.StringVar(&settings.proxyHost, "proxy-host", "", "Proxy host (ex: myproxy.com, 1.2.3.4")
 	flag.IntVar(&settings.proxyPort, "proxy-port", 1080, "Proxy port")
 	flag.StringVar(&settings.proxyUser, "proxy-user", "", "Proxy user")
 	flag.StringVar(&settings.proxyPassword, "proxy-password", "", "Proxy password")
+	flag.StringVar(&settings.telemetry, "telemetry", "mixpanel", "Telemetry sink: mixpanel/file/webhook/off")
+	flag.StringVar(&settings.telemetryFile, "telemetry-file", "", "JSONL file used by the file telemetry sink")
+	flag.StringVar(&settings.telemetryURL, "telemetry-url", "", "URL used by the webhook telemetry sink")
+	flag.StringVar(&settings.webhookURLs, "webhook-urls", "", "Comma separated URLs receiving torrent events, more can be registered on /api/v1/webhooks")
+	flag.StringVar(&settings.webhookSecret, "webhook-secret", os.Getenv("SCRAPMAGNET_WEBHOOK_SECRET"), "Secret signing webhook deliveries when a webhook has none")
+	flag.StringVar(&settings.onAdded, "on-added", "", "Executable run when a torrent is added")
+	flag.StringVar(&settings.onMetadata, "on-metadata", "", "Executable run when torrent metadata is received")
+	flag.StringVar(&settings.onFinished, "on-finished", "", "Executable run when a torrent is finished")
+	flag.StringVar(&settings.onRemoved, "on-removed", "", "Executable run when a torrent is removed")
+	flag.IntVar(&settings.hookTimeout, "hook-timeout", 60, "Hooks are killed after running this long")
+	flag.IntVar(&settings.hookConcurrency, "hook-concurrency", 2, "Maximum number of hooks running at once")
 	flag.StringVar(&settings.mixpanelToken, "mixpanel-token", "", "Mixpanel token")
 	flag.StringVar(&settings.mixpanelData, "mixpanel-data", "", "Mixpanel data")
 	flag.Parse()
 
+	if settings.videoNotReadyMode != notReadyRedirect && settings.videoNotReadyMode != notReadyAccepted {
+		log.Printf("[scrapmagnet] Unknown video not ready mode %v, redirecting", settings.videoNotReadyMode)
+		settings.videoNotReadyMode = notReadyRedirect
+	}
+
+	if settings.filePolicy != filePolicyStreamed && settings.filePolicy != filePolicyAll {
+		log.Printf("[scrapmagnet] Unknown file policy %v, downloading all files", settings.filePolicy)
+		settings.filePolicy = filePolicyAll
+	}
+
+	telemetry = NewTelemetry(NewTelemetrySink())
 	bitTorrent = NewBitTorrent()
+	webhooks = NewWebhookNotifier()
+	webhooks.Load()
+	bitTorrent.events.AddHandler(webhooks)
+	hooks = NewHookRunner()
+	bitTorrent.events.AddHandler(hooks)
 	httpServer = NewHttp(bitTorrent)
 
 	log.Print("[scrapmagnet] Starting")
+	telemetry.Start()
+	hooks.Start()
 	bitTorrent.Start()
 	httpServer.Start()
 	httpServer.Stop()
 	bitTorrent.Stop()
+	telemetry.Stop()
 	log.Print("[scrapmagnet] Stopping")
 }
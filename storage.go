@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideStorageRoot = errors.New("Path outside of storage root")
+
+// resolveStoragePath resolves a path relative to the storage root and
+// rejects anything escaping it. Without a storage root any path is accepted.
+func resolveStoragePath(storagePath string) (string, error) {
+	if settings.storageRoot == "" {
+		return storagePath, nil
+	}
+
+	storageRoot, err := filepath.Abs(settings.storageRoot)
+	if err != nil {
+		return "", err
+	}
+
+	result := filepath.Clean(storagePath)
+	if !filepath.IsAbs(result) {
+		result = filepath.Join(storageRoot, result)
+	}
+
+	if !isInsideDir(storageRoot, result) {
+		return "", errOutsideStorageRoot
+	}
+	return result, nil
+}
+
+// checkStoragePath verifies an existing path, symlinks included, stays
+// inside the storage root.
+func checkStoragePath(fullpath string) error {
+	if settings.storageRoot == "" {
+		return nil
+	}
+
+	storageRoot, err := filepath.Abs(settings.storageRoot)
+	if err != nil {
+		return err
+	}
+	if realStorageRoot, err := filepath.EvalSymlinks(storageRoot); err == nil {
+		storageRoot = realStorageRoot
+	}
+
+	realPath, err := filepath.Abs(fullpath)
+	if err != nil {
+		return err
+	}
+	if realPath, err = evalExistingSymlinks(realPath); err != nil {
+		// Ex: a dangling symlink, where it leads can't be verified
+		return errOutsideStorageRoot
+	}
+
+	if !isInsideDir(storageRoot, realPath) {
+		return errOutsideStorageRoot
+	}
+	return nil
+}
+
+// evalExistingSymlinks resolves the symlinks of the part of path which
+// exists, the rest is yet to be created.
+func evalExistingSymlinks(path string) (string, error) {
+	rest := ""
+	for {
+		_, err := os.Lstat(path)
+		if err == nil {
+			evaluatedPath, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(evaluatedPath, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+func isInsideDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
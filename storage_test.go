@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setTestStorageRoot returns the function restoring the storage root.
+func setTestStorageRoot(storageRoot string) func() {
+	previous := settings.storageRoot
+	settings.storageRoot = storageRoot
+	return func() { settings.storageRoot = previous }
+}
+
+func TestIsInsideDir(t *testing.T) {
+	tests := []struct {
+		dir      string
+		path     string
+		expected bool
+	}{
+		{"/data", "/data", true},
+		{"/data", "/data/movies/file.mkv", true},
+		{"/data", "/data/..foo", true},
+		{"/data", "/data/movies/../file.mkv", true},
+		{"/data", "/data/../etc/passwd", false},
+		{"/data", "/data2", false},
+		{"/data", "/data2/file.mkv", false},
+		{"/data", "/", false},
+		{"/data", "/etc/passwd", false},
+	}
+
+	for _, test := range tests {
+		if result := isInsideDir(test.dir, test.path); result != test.expected {
+			t.Errorf("isInsideDir(%q, %q) = %v, expected %v", test.dir, test.path, result, test.expected)
+		}
+	}
+}
+
+func TestResolveStoragePath(t *testing.T) {
+	defer setTestStorageRoot("/data")()
+
+	tests := []struct {
+		storagePath string
+		expected    string
+		err         error
+	}{
+		{"", "/data", nil},
+		{"movies", "/data/movies", nil},
+		{"movies/../shows", "/data/shows", nil},
+		{"..foo", "/data/..foo", nil},
+		{"/data/movies", "/data/movies", nil},
+		{"/data", "/data", nil},
+		{"..", "", errOutsideStorageRoot},
+		{"../data2", "", errOutsideStorageRoot},
+		{"movies/../../etc", "", errOutsideStorageRoot},
+		{"/etc", "", errOutsideStorageRoot},
+		{"/data2", "", errOutsideStorageRoot},
+		{"/data/../etc", "", errOutsideStorageRoot},
+	}
+
+	for _, test := range tests {
+		result, err := resolveStoragePath(test.storagePath)
+		if result != test.expected || err != test.err {
+			t.Errorf("resolveStoragePath(%q) = %q, %v, expected %q, %v", test.storagePath, result, err, test.expected, test.err)
+		}
+	}
+
+	settings.storageRoot = ""
+	if result, err := resolveStoragePath("../anywhere"); result != "../anywhere" || err != nil {
+		t.Errorf("resolveStoragePath() without storage root = %q, %v", result, err)
+	}
+}
+
+func TestCheckStoragePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrapmagnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storageRoot := filepath.Join(dir, "data")
+	outside := filepath.Join(dir, "data2")
+	for _, path := range []string{filepath.Join(storageRoot, "movies"), outside} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(storageRoot, "escape"):  outside,
+		filepath.Join(storageRoot, "parent"):  dir,
+		filepath.Join(storageRoot, "inside"):  filepath.Join(storageRoot, "movies"),
+		filepath.Join(dir, "root-link"):       storageRoot,
+		filepath.Join(storageRoot, "passwd"):  "/etc/passwd",
+		filepath.Join(storageRoot, "dangles"): filepath.Join(outside, "missing"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer setTestStorageRoot(storageRoot)()
+
+	tests := []struct {
+		path string
+		err  error
+	}{
+		{storageRoot, nil},
+		{filepath.Join(storageRoot, "movies"), nil},
+		{filepath.Join(storageRoot, "movies", "new.mkv"), nil},
+		{filepath.Join(storageRoot, "inside"), nil},
+		{filepath.Join(storageRoot, "..foo"), nil},
+		{filepath.Join(storageRoot, "inside", "new", "file.mkv"), nil},
+		{filepath.Join(storageRoot, "escape"), errOutsideStorageRoot},
+		{filepath.Join(storageRoot, "escape", "new", "file.mkv"), errOutsideStorageRoot},
+		{filepath.Join(storageRoot, "dangles"), errOutsideStorageRoot},
+		{filepath.Join(storageRoot, "parent"), errOutsideStorageRoot},
+		{filepath.Join(storageRoot, "passwd"), errOutsideStorageRoot},
+		{outside, errOutsideStorageRoot},
+		{filepath.Join(storageRoot, "..", "data2"), errOutsideStorageRoot},
+	}
+	for _, test := range tests {
+		if err := checkStoragePath(test.path); err != test.err {
+			t.Errorf("checkStoragePath(%q) = %v, expected %v", test.path, err, test.err)
+		}
+	}
+
+	// The storage root itself may be a symlink
+	settings.storageRoot = filepath.Join(dir, "root-link")
+	if err := checkStoragePath(filepath.Join(storageRoot, "movies")); err != nil {
+		t.Errorf("checkStoragePath() through a linked storage root = %v", err)
+	}
+	if err := checkStoragePath(filepath.Join(storageRoot, "escape")); err != errOutsideStorageRoot {
+		t.Errorf("checkStoragePath() of a link out of a linked storage root = %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxSubtitleSize = 10 * 1024 * 1024
+
+var videoExtensions = map[string]bool{
+	".avi":  true,
+	".flv":  true,
+	".m2ts": true,
+	".m4v":  true,
+	".mkv":  true,
+	".mov":  true,
+	".mp4":  true,
+	".mpeg": true,
+	".mpg":  true,
+	".ts":   true,
+	".webm": true,
+	".wmv":  true,
+}
+
+var subtitleContentTypes = map[string]string{
+	"srt": "application/x-subrip",
+	"ass": "text/x-ssa",
+	"ssa": "text/x-ssa",
+	"vtt": "text/vtt; charset=utf-8",
+	"sub": "text/plain",
+	"smi": "application/smil",
+}
+
+// subtitleLanguages maps the usual language tags of subtitle file names to
+// ISO 639-1 codes.
+var subtitleLanguages = map[string]string{
+	"en": "en", "eng": "en", "english": "en",
+	"fr": "fr", "fre": "fr", "fra": "fr", "french": "fr",
+	"es": "es", "spa": "es", "spanish": "es",
+	"de": "de", "ger": "de", "deu": "de", "german": "de",
+	"it": "it", "ita": "it", "italian": "it",
+	"pt": "pt", "por": "pt", "portuguese": "pt",
+	"nl": "nl", "dut": "nl", "nld": "nl", "dutch": "nl",
+	"ru": "ru", "rus": "ru", "russian": "ru",
+	"pl": "pl", "pol": "pl", "polish": "pl",
+	"sv": "sv", "swe": "sv", "swedish": "sv",
+	"tr": "tr", "tur": "tr", "turkish": "tr",
+	"ar": "ar", "ara": "ar", "arabic": "ar",
+	"ja": "ja", "jpn": "ja", "japanese": "ja",
+	"ko": "ko", "kor": "ko", "korean": "ko",
+	"zh": "zh", "chi": "zh", "zho": "zh", "chinese": "zh",
+}
+
+var subtitleDirs = map[string]bool{
+	"sub":       true,
+	"subs":      true,
+	"subtitle":  true,
+	"subtitles": true,
+}
+
+type SubtitleInfo struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Format   string `json:"format"`
+	Language string `json:"language,omitempty"`
+	Label    string `json:"label,omitempty"`
+}
+
+func getSubtitleFormat(filePath string) string {
+	format := strings.TrimPrefix(strings.ToLower(path.Ext(filePath)), ".")
+	if _, ok := subtitleContentTypes[format]; ok {
+		return format
+	}
+	return ""
+}
+
+func isVideo(filePath string) bool {
+	return videoExtensions[strings.ToLower(path.Ext(filePath))]
+}
+
+// getSubtitleLanguage parses tags like "en", "eng.forced" or "2_English".
+func getSubtitleLanguage(label string) string {
+	for _, tag := range strings.FieldsFunc(strings.ToLower(label), func(r rune) bool {
+		return r == '.' || r == '_' || r == '-' || r == ' ' || (r >= '0' && r <= '9')
+	}) {
+		if language, ok := subtitleLanguages[tag]; ok {
+			return language
+		}
+	}
+	return ""
+}
+
+// matchSubtitle tells whether the subtitle goes with the video, and returns
+// its label. Subtitles are either named after the video, ex: Movie.en.srt, or
+// stored in a subtitles directory, ex: Subs/Movie/2_English.srt or
+// Subs/English.srt when the video is alone in its directory.
+func matchSubtitle(videoPath string, subtitlePath string, videoAlone bool) (string, bool) {
+	videoDir := path.Dir(videoPath)
+	videoBase := strings.TrimSuffix(path.Base(videoPath), path.Ext(videoPath))
+	subtitleDir := path.Dir(subtitlePath)
+	subtitleBase := strings.TrimSuffix(path.Base(subtitlePath), path.Ext(subtitlePath))
+
+	if subtitleDir == videoDir {
+		if strings.EqualFold(subtitleBase, videoBase) {
+			return "", true
+		}
+		if len(subtitleBase) > len(videoBase) && strings.EqualFold(subtitleBase[:len(videoBase)+1], videoBase+".") {
+			return subtitleBase[len(videoBase)+1:], true
+		}
+		return "", false
+	}
+
+	relativeDir := strings.TrimPrefix(subtitleDir, videoDir+"/")
+	if videoDir == "." {
+		relativeDir = subtitleDir
+	}
+	if relativeDir == subtitleDir && videoDir != "." {
+		return "", false
+	}
+
+	parts := strings.Split(relativeDir, "/")
+	if !subtitleDirs[strings.ToLower(parts[0])] {
+		return "", false
+	}
+	switch {
+	case len(parts) == 1 && videoAlone:
+		return subtitleBase, true
+	case len(parts) == 2 && strings.EqualFold(parts[1], videoBase):
+		return subtitleBase, true
+	}
+	return "", false
+}
+
+// attachSubtitles lists the subtitles of each video file.
+func attachSubtitles(torrentFileInfos []*TorrentFileInfo) {
+	videoCounts := make(map[string]int)
+	for _, torrentFileInfo := range torrentFileInfos {
+		if isVideo(torrentFileInfo.Path) {
+			videoCounts[path.Dir(torrentFileInfo.Path)]++
+		}
+	}
+
+	for _, video := range torrentFileInfos {
+		if !isVideo(video.Path) {
+			continue
+		}
+		for _, torrentFileInfo := range torrentFileInfos {
+			format := getSubtitleFormat(torrentFileInfo.Path)
+			if format == "" {
+				continue
+			}
+			if label, ok := matchSubtitle(video.Path, torrentFileInfo.Path, videoCounts[path.Dir(video.Path)] == 1); ok {
+				video.Subtitles = append(video.Subtitles, &SubtitleInfo{
+					Index:    torrentFileInfo.Index,
+					Path:     torrentFileInfo.Path,
+					Size:     torrentFileInfo.Size,
+					Format:   format,
+					Language: getSubtitleLanguage(label),
+					Label:    label,
+				})
+			}
+		}
+	}
+}
+
+// selectSubtitle picks the subtitle_index file, or the subtitle of the video
+// in the requested language, or its first subtitle.
+func selectSubtitle(r *http.Request, torrentInfo *TorrentInfo, video *TorrentFileInfo) (*TorrentFileInfo, error) {
+	if subtitleIndex := getQueryParam(r, "subtitle_index", ""); subtitleIndex != "" {
+		index, err := strconv.Atoi(subtitleIndex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid subtitle index")
+		}
+		torrentFileInfo := torrentInfo.GetTorrentFileInfoByIndex(index)
+		if torrentFileInfo == nil || getSubtitleFormat(torrentFileInfo.Path) == "" {
+			return nil, nil
+		}
+		return torrentFileInfo, nil
+	}
+
+	if video == nil {
+		return nil, nil
+	}
+	language := strings.ToLower(getQueryParam(r, "language", ""))
+	for _, subtitleInfo := range video.Subtitles {
+		if language == "" || subtitleInfo.Language == language || strings.EqualFold(subtitleInfo.Label, language) {
+			return torrentInfo.GetTorrentFileInfoByIndex(subtitleInfo.Index), nil
+		}
+	}
+	return nil, nil
+}
+
+// prioritizeSubtitle downloads the whole file before anything else, players
+// need it before starting.
+func (tfi *TorrentFileInfo) prioritizeSubtitle() {
+	bitTorrent.wantTorrentFile(tfi)
+	for i := tfi.startPiece; i <= tfi.endPiece; i++ {
+		if !tfi.handle.Have_piece(i) {
+			tfi.handle.Piece_priority(i, 7)
+			tfi.handle.Set_piece_deadline(i, 1000, 0)
+		}
+	}
+}
+
+func subtitles(w http.ResponseWriter, r *http.Request) {
+	notReadyMode := getQueryParam(r, "not_ready", settings.videoNotReadyMode)
+	if notReadyMode != notReadyRedirect && notReadyMode != notReadyAccepted {
+		http.Error(w, "Invalid not_ready mode", http.StatusBadRequest)
+		return
+	}
+
+	format := strings.ToLower(getQueryParam(r, "format", ""))
+	if format == "webvtt" {
+		format = "vtt"
+	} else if format != "" && format != "vtt" {
+		http.Error(w, "Invalid format, subtitles can only be converted to vtt", http.StatusBadRequest)
+		return
+	}
+
+	fileSelector, err := getFileSelector(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	infoHash, ok := getRequestInfoHash(w, r, fileSelector)
+	if !ok {
+		return
+	}
+
+	torrentInfo := httpInstance.bitTorrent.GetTorrentInfo(infoHash)
+	if torrentInfo == nil || len(torrentInfo.Files) == 0 {
+		notReady(w, r, "0", notReadyMode, NewVideoReadiness(infoHash, torrentInfo, nil, false))
+		return
+	}
+
+	httpInstance.bitTorrent.AddConnection(infoHash)
+	defer httpInstance.bitTorrent.RemoveConnection(infoHash)
+
+	video, err := fileSelector.Select(torrentInfo)
+	if err != nil && err != errTorrentFileNotFound {
+		http.Error(w, "Invalid file match: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subtitle, err := selectSubtitle(r, torrentInfo, video)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if subtitle == nil {
+		subtitleInfos := make([]*SubtitleInfo, 0)
+		if video != nil {
+			subtitleInfos = append(subtitleInfos, video.Subtitles...)
+		}
+		serveJsonStatus(w, http.StatusNotFound, map[string]interface{}{"error": "Subtitle not found", "subtitles": subtitleInfos})
+		return
+	}
+
+	subtitleFormat := getSubtitleFormat(subtitle.Path)
+	if format == "vtt" && subtitleFormat != "vtt" && subtitleFormat != "srt" {
+		http.Error(w, fmt.Sprintf("Cannot convert %v subtitles to vtt", subtitleFormat), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	subtitle.prioritizeSubtitle()
+	if err := subtitle.Open(r.Context(), torrentInfo.DownloadDir); err != nil {
+		fileOpenFailed(w, err)
+		return
+	}
+	defer subtitle.Close()
+
+	if format == "" || format == subtitleFormat {
+		w.Header().Set("Content-Type", subtitleContentTypes[subtitleFormat])
+		http.ServeContent(w, r, subtitle.Path, time.Time{}, subtitle)
+		return
+	}
+
+	if subtitle.Size > maxSubtitleSize {
+		http.Error(w, "Subtitle too big to be converted", http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(subtitle, subtitle.Size))
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			http.Error(w, "Timed out waiting for file", http.StatusGatewayTimeout)
+		} else if err != context.Canceled {
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", subtitleContentTypes["vtt"])
+	http.ServeContent(w, r, strings.TrimSuffix(subtitle.Path, path.Ext(subtitle.Path))+".vtt", time.Time{}, bytes.NewReader(convertSRTToWebVTT(data)))
+}
+
+func fileOpenFailed(w http.ResponseWriter, err error) {
+	if err == errOutsideStorageRoot {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	} else if err == context.DeadlineExceeded {
+		http.Error(w, "Timed out waiting for file", http.StatusGatewayTimeout)
+	} else if err != context.Canceled {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+	}
+}
+
+var (
+	srtTimingRegExp = regexp.MustCompile(`^\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})(.*)$`)
+	srtTagRegExp    = regexp.MustCompile(`(?i)</?font[^>]*>|\{\\[^}]*\}`)
+)
+
+// convertSRTToWebVTT also converts Windows-1252 files, WebVTT must be UTF-8.
+func convertSRTToWebVTT(data []byte) []byte {
+	text := decodeSubtitleText(data)
+	text = strings.TrimPrefix(text, "\ufeff")
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\r", "\n", -1)
+
+	var result bytes.Buffer
+	result.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(text, "\n") {
+		if match := srtTimingRegExp.FindStringSubmatch(line); match != nil {
+			fmt.Fprintf(&result, "%s --> %s%s\n", formatVTTTimestamp(match[1:5]), formatVTTTimestamp(match[5:9]), match[9])
+			continue
+		}
+		result.WriteString(srtTagRegExp.ReplaceAllString(line, ""))
+		result.WriteByte('\n')
+	}
+	return result.Bytes()
+}
+
+// formatVTTTimestamp formats hours, minutes, seconds and a fraction of a
+// second, "5" being 500 milliseconds.
+func formatVTTTimestamp(parts []string) string {
+	hours, _ := strconv.Atoi(parts[0])
+	minutes, _ := strconv.Atoi(parts[1])
+	seconds, _ := strconv.Atoi(parts[2])
+	milliseconds, _ := strconv.Atoi((parts[3] + "00")[:3])
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", hours, minutes, seconds, milliseconds)
+}
+
+// windows1252 maps the 0x80-0x9F bytes, the others match Latin-1.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+func decodeSubtitleText(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	runes := make([]rune, 0, len(data))
+	for _, b := range data {
+		if b >= 0x80 && b < 0xA0 {
+			runes = append(runes, windows1252[b-0x80])
+		} else {
+			runes = append(runes, rune(b))
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConvertSRTToWebVTT(t *testing.T) {
+	tests := []struct {
+		srt      string
+		expected string
+	}{
+		{
+			"1\n00:00:01,000 --> 00:00:02,500\nHello\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello\n\n",
+		},
+		{
+			"\ufeff1\r\n0:0:1,5 --> 0:0:2,25 X1:10\r\n<font color=\"red\">Red</font> {\\an8}<i>top</i>\r\n",
+			"WEBVTT\n\n1\n00:00:01.500 --> 00:00:02.250 X1:10\nRed <i>top</i>\n\n",
+		},
+		{
+			"2\r00:01:00.1 --> 01:00:00.123\rOld Mac line endings\r",
+			"WEBVTT\n\n2\n00:01:00.100 --> 01:00:00.123\nOld Mac line endings\n\n",
+		},
+		{
+			"3\n00:00:01,000 --> 00:00:02,000\nCaf\xe9 \x93quoted\x94 \x80 5\n",
+			"WEBVTT\n\n3\n00:00:01.000 --> 00:00:02.000\nCafé “quoted” € 5\n\n",
+		},
+		{
+			"4\n00:00:01,000 --> 00:00:02,000\nDéjà vu, 00:00:01,000 --> 00:00:02,000 as text\n",
+			"WEBVTT\n\n4\n00:00:01.000 --> 00:00:02.000\nDéjà vu, 00:00:01,000 --> 00:00:02,000 as text\n\n",
+		},
+	}
+
+	for _, test := range tests {
+		if result := string(convertSRTToWebVTT([]byte(test.srt))); result != test.expected {
+			t.Errorf("convertSRTToWebVTT(%q) = %q, expected %q", test.srt, result, test.expected)
+		}
+	}
+}
+
+func TestDecodeSubtitleText(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"d\xc3\xa9j\xc3\xa0", "déjà"},
+		{"d\xe9j\xe0", "déjà"},
+		{"\x80\x8a\x9f\xa0\xff", "€ŠŸ ÿ"},
+		{"\x81\x8d", "\u0081\u008d"},
+	}
+
+	for _, test := range tests {
+		if result := decodeSubtitleText([]byte(test.data)); result != test.expected {
+			t.Errorf("decodeSubtitleText(%q) = %q, expected %q", test.data, result, test.expected)
+		}
+	}
+}
+
+func TestMatchSubtitle(t *testing.T) {
+	tests := []struct {
+		videoPath    string
+		subtitlePath string
+		videoAlone   bool
+		label        string
+		ok           bool
+	}{
+		{"Movie/Movie.mkv", "Movie/Movie.srt", true, "", true},
+		{"Movie/Movie.mkv", "Movie/movie.EN.srt", true, "EN", true},
+		{"Movie/Movie.mkv", "Movie/Movies.srt", true, "", false},
+		{"Movie/Movie.mkv", "Movie/Other.srt", true, "", false},
+		{"Movie/Movie.mkv", "Movie/Subs/English.srt", true, "English", true},
+		{"Movie/Movie.mkv", "Movie/Subs/English.srt", false, "", false},
+		{"Movie/Movie.mkv", "Movie/Subs/Movie/2_English.srt", false, "2_English", true},
+		{"Movie/Movie.mkv", "Movie/Subs/Other/2_English.srt", false, "", false},
+		{"Movie/Movie.mkv", "Movie/Extras/English.srt", true, "", false},
+		{"Movie/Movie.mkv", "Other/Subs/English.srt", true, "", false},
+		{"Movie.mkv", "Subs/English.srt", true, "English", true},
+		{"Movie.mkv", "Movie.fr.srt", true, "fr", true},
+	}
+
+	for _, test := range tests {
+		label, ok := matchSubtitle(test.videoPath, test.subtitlePath, test.videoAlone)
+		if label != test.label || ok != test.ok {
+			t.Errorf("matchSubtitle(%q, %q, %v) = %q, %v, expected %q, %v", test.videoPath, test.subtitlePath, test.videoAlone, label, ok, test.label, test.ok)
+		}
+	}
+}
+
+func TestGetSubtitleLanguage(t *testing.T) {
+	tests := []struct {
+		label    string
+		expected string
+	}{
+		{"en", "en"},
+		{"eng.forced", "en"},
+		{"2_English", "en"},
+		{"Brazilian.Portuguese", "pt"},
+		{"SDH", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if result := getSubtitleLanguage(test.label); result != test.expected {
+			t.Errorf("getSubtitleLanguage(%q) = %q, expected %q", test.label, result, test.expected)
+		}
+	}
+}
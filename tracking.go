@@ -1,22 +1,237 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dukex/mixpanel"
 )
 
-var (
-	publicIP = ""
+const (
+	telemetryQueueSize    = 256
+	telemetryMaxAttempts  = 3
+	telemetryRetryDelay   = time.Second
+	telemetryStopTimeout  = 2 * time.Second
+	telemetryHTTPTimeout  = 10 * time.Second
+	telemetryDistinctFile = "telemetry-id"
 )
 
+type TelemetrySink interface {
+	Identify(distinctId string, properties map[string]interface{}) error
+	Track(distinctId string, eventName string, properties map[string]interface{}) error
+}
+
+type noopSink struct{}
+
+func (s *noopSink) Identify(distinctId string, properties map[string]interface{}) error {
+	return nil
+}
+
+func (s *noopSink) Track(distinctId string, eventName string, properties map[string]interface{}) error {
+	return nil
+}
+
+type mixpanelSink struct {
+	token string
+}
+
+func (s *mixpanelSink) Identify(distinctId string, properties map[string]interface{}) error {
+	client := mixpanel.NewMixpanel(s.token)
+	return client.Identify(distinctId).Update("$set", properties)
+}
+
+func (s *mixpanelSink) Track(distinctId string, eventName string, properties map[string]interface{}) error {
+	client := mixpanel.NewMixpanel(s.token)
+	return client.Track(distinctId, eventName, properties)
+}
+
+type telemetryRecord struct {
+	Type       string                 `json:"type"`
+	DistinctId string                 `json:"distinct_id"`
+	Event      string                 `json:"event,omitempty"`
+	Time       time.Time              `json:"time"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// fileSink appends one JSON record per line.
+type fileSink struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func (s *fileSink) write(record *telemetryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileSink) Identify(distinctId string, properties map[string]interface{}) error {
+	return s.write(&telemetryRecord{Type: "identify", DistinctId: distinctId, Time: time.Now(), Properties: properties})
+}
+
+func (s *fileSink) Track(distinctId string, eventName string, properties map[string]interface{}) error {
+	return s.write(&telemetryRecord{Type: "track", DistinctId: distinctId, Event: eventName, Time: time.Now(), Properties: properties})
+}
+
+// webhookSink POSTs each record as JSON.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) post(record *telemetryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Telemetry webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Identify(distinctId string, properties map[string]interface{}) error {
+	return s.post(&telemetryRecord{Type: "identify", DistinctId: distinctId, Time: time.Now(), Properties: properties})
+}
+
+func (s *webhookSink) Track(distinctId string, eventName string, properties map[string]interface{}) error {
+	return s.post(&telemetryRecord{Type: "track", DistinctId: distinctId, Event: eventName, Time: time.Now(), Properties: properties})
+}
+
+func NewTelemetrySink() TelemetrySink {
+	switch settings.telemetry {
+	case "mixpanel":
+		if settings.mixpanelToken != "" {
+			return &mixpanelSink{token: settings.mixpanelToken}
+		}
+	case "file":
+		if settings.telemetryFile != "" {
+			return &fileSink{path: settings.telemetryFile}
+		}
+		log.Print("[scrapmagnet] Telemetry file not set, telemetry disabled")
+	case "webhook":
+		if settings.telemetryURL != "" {
+			return &webhookSink{url: settings.telemetryURL, client: &http.Client{Timeout: telemetryHTTPTimeout}}
+		}
+		log.Print("[scrapmagnet] Telemetry URL not set, telemetry disabled")
+	case "off":
+	default:
+		log.Printf("[scrapmagnet] Unknown telemetry %v, telemetry disabled", settings.telemetry)
+	}
+	return &noopSink{}
+}
+
+// Telemetry delivers records through a bounded queue, so neither the alert
+// pump nor HTTP handlers ever wait on the network. Records are dropped when
+// the queue is full.
+type Telemetry struct {
+	sink       TelemetrySink
+	distinctId string
+	queue      chan func() error
+}
+
+var telemetry *Telemetry
+
+func NewTelemetry(sink TelemetrySink) *Telemetry {
+	return &Telemetry{
+		sink:       sink,
+		distinctId: getDistinctId(),
+		queue:      make(chan func() error, telemetryQueueSize),
+	}
+}
+
+func (t *Telemetry) Start() {
+	go func() {
+		for send := range t.queue {
+			for attempt := 1; attempt <= telemetryMaxAttempts; attempt++ {
+				err := send()
+				if err == nil {
+					break
+				}
+				if attempt == telemetryMaxAttempts {
+					log.Printf("[scrapmagnet] Telemetry dropped: %v", err)
+					break
+				}
+				time.Sleep(telemetryRetryDelay * time.Duration(1<<uint(attempt-1)))
+			}
+		}
+	}()
+}
+
+// Stop gives pending records a chance to be delivered. The queue is left
+// open as alerts may still be tracked afterwards.
+func (t *Telemetry) Stop() {
+	flushedChan := make(chan bool)
+	t.enqueue(func() error {
+		close(flushedChan)
+		return nil
+	})
+
+	select {
+	case <-flushedChan:
+	case <-time.After(telemetryStopTimeout):
+		log.Print("[scrapmagnet] Telemetry not flushed")
+	}
+}
+
+func (t *Telemetry) enqueue(send func() error) {
+	if _, ok := t.sink.(*noopSink); ok {
+		send = func() error { return nil }
+	}
+
+	select {
+	case t.queue <- send:
+	default:
+		log.Print("[scrapmagnet] Telemetry queue full, dropping")
+	}
+}
+
+func (t *Telemetry) Identify(properties map[string]interface{}) {
+	t.enqueue(func() error {
+		return t.sink.Identify(t.distinctId, properties)
+	})
+}
+
+func (t *Telemetry) Track(eventName string, properties map[string]interface{}) {
+	t.enqueue(func() error {
+		return t.sink.Track(t.distinctId, eventName, properties)
+	})
+}
+
 func peopleSet() {
 	properties := make(map[string]interface{})
 	properties["Server OS"] = runtime.GOOS
@@ -30,9 +245,7 @@ func peopleSet() {
 		}
 	}
 
-	client := mixpanel.NewMixpanel(settings.mixpanelToken)
-	people := client.Identify(getDistinctId())
-	people.Update("$set", properties)
+	telemetry.Identify(properties)
 }
 
 func trackingEvent(eventName string, properties map[string]interface{}, mixpanelData string) {
@@ -55,28 +268,30 @@ func trackingEvent(eventName string, properties map[string]interface{}, mixpanel
 		}
 	}
 
-	client := mixpanel.NewMixpanel(settings.mixpanelToken)
-	client.Track(getDistinctId(), eventName, properties)
+	telemetry.Track(eventName, properties)
 }
 
-func getPublicIP() string {
-	if publicIP == "" {
-		if resp, err := http.Get("http://myexternalip.com/raw"); err == nil {
-			defer resp.Body.Close()
-			if content, err := ioutil.ReadAll(resp.Body); err == nil {
-				publicIP = string(content)
-			} else {
-				log.Panic(err)
+// getDistinctId returns a random ID persisted in the state directory, or a
+// hash of the host name when there is none.
+func getDistinctId() string {
+	if settings.stateDir != "" {
+		distinctIdPath := filepath.Join(settings.stateDir, telemetryDistinctFile)
+		if data, err := ioutil.ReadFile(distinctIdPath); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			return strings.TrimSpace(string(data))
+		}
+
+		randomId := make([]byte, 20)
+		if _, err := rand.Read(randomId); err == nil {
+			distinctId := hex.EncodeToString(randomId)
+			if err := os.MkdirAll(settings.stateDir, 0755); err == nil {
+				if err := ioutil.WriteFile(distinctIdPath, []byte(distinctId), 0644); err == nil {
+					return distinctId
+				}
 			}
-		} else {
-			log.Panic(err)
 		}
 	}
 
-	return publicIP
-}
-
-func getDistinctId() string {
-	data := []byte(runtime.GOOS + runtime.GOARCH + getPublicIP())
+	hostname, _ := os.Hostname()
+	data := []byte(runtime.GOOS + runtime.GOARCH + hostname)
 	return fmt.Sprintf("%x", sha1.Sum(data))
 }
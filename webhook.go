@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize       = 64
+	webhookMaxAttempts     = 5
+	webhookRetryDelay      = 2 * time.Second
+	webhookHTTPTimeout     = 10 * time.Second
+	webhookSignatureHeader = "X-Scrapmagnet-Signature"
+	webhookEventHeader     = "X-Scrapmagnet-Event"
+	webhookDeliveryHeader  = "X-Scrapmagnet-Delivery"
+	webhooksDir            = "webhooks"
+	webhooksFile           = "webhooks.json"
+)
+
+// webhookEvents are the events webhooks can receive, stats are too frequent.
+var webhookEvents = map[string]bool{
+	"added":             true,
+	"add_failed":        true,
+	"metadata_received": true,
+	"paused":            true,
+	"resumed":           true,
+	"finished":          true,
+	"removed":           true,
+	"delete_failed":     true,
+	"tracker_error":     true,
+	"stream_started":    true,
+	"stream_stopped":    true,
+}
+
+var (
+	errWebhookInvalidURL   = errors.New("Webhook URL must be an absolute http or https URL")
+	errWebhookInvalidEvent = errors.New("Unknown webhook event")
+)
+
+type Webhook struct {
+	Id     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+func (w *Webhook) validate() error {
+	if parsedURL, err := url.Parse(w.URL); err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return errWebhookInvalidURL
+	}
+	for _, eventType := range w.Events {
+		if !webhookEvents[eventType] {
+			return fmt.Errorf("%v: %v", errWebhookInvalidEvent, eventType)
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) accepts(eventType string) bool {
+	if !webhookEvents[eventType] {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, acceptedType := range w.Events {
+		if acceptedType == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the HMAC-SHA256 of the body, or nothing without a secret.
+func (w *Webhook) sign(body []byte) string {
+	secret := w.Secret
+	if secret == "" {
+		secret = settings.webhookSecret
+	}
+	if secret == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookWorker delivers events to a single webhook in order, so a slow
+// receiver only delays itself.
+type webhookWorker struct {
+	webhook    *Webhook
+	persistent bool
+	queue      chan *Event
+	stopChan   chan bool
+}
+
+// WebhookNotifier POSTs torrent events to the registered webhooks. Webhooks
+// added through the API are saved in the state directory, those from the
+// command line are not.
+type WebhookNotifier struct {
+	mutex   sync.Mutex
+	workers map[string]*webhookWorker
+	client  *http.Client
+}
+
+var webhooks *WebhookNotifier
+
+func NewWebhookNotifier() *WebhookNotifier {
+	return &WebhookNotifier{
+		workers: make(map[string]*webhookWorker),
+		client:  &http.Client{Timeout: webhookHTTPTimeout},
+	}
+}
+
+func newWebhookId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// getWebhooksPath is kept apart from the resume info of torrents.
+func getWebhooksPath() string {
+	return filepath.Join(settings.stateDir, webhooksDir, webhooksFile)
+}
+
+func (wn *WebhookNotifier) Load() {
+	for _, webhookURL := range strings.Split(settings.webhookURLs, ",") {
+		if webhookURL = strings.TrimSpace(webhookURL); webhookURL != "" {
+			if _, err := wn.Add(&Webhook{URL: webhookURL}, false); err != nil {
+				log.Printf("[scrapmagnet] Ignoring webhook %v: %v", webhookURL, err)
+			}
+		}
+	}
+
+	if settings.stateDir == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(getWebhooksPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		return
+	}
+
+	savedWebhooks := make([]*Webhook, 0)
+	if err := json.Unmarshal(data, &savedWebhooks); err != nil {
+		log.Print(err)
+		return
+	}
+	for _, webhook := range savedWebhooks {
+		if _, err := wn.Add(webhook, true); err != nil {
+			log.Printf("[scrapmagnet] Ignoring webhook %v: %v", webhook.URL, err)
+		}
+	}
+}
+
+// save is called with the mutex held.
+func (wn *WebhookNotifier) save() {
+	if settings.stateDir == "" {
+		return
+	}
+
+	savedWebhooks := make([]*Webhook, 0)
+	for _, worker := range wn.workers {
+		if worker.persistent {
+			savedWebhooks = append(savedWebhooks, worker.webhook)
+		}
+	}
+	sort.Sort(byWebhookId(savedWebhooks))
+
+	data, err := json.Marshal(savedWebhooks)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	// Webhooks hold their signing secret
+	if err := os.MkdirAll(filepath.Dir(getWebhooksPath()), 0700); err != nil {
+		log.Print(err)
+		return
+	}
+	if err := writeFileAtomic(getWebhooksPath(), data, 0600); err != nil {
+		log.Print(err)
+	}
+}
+
+func (wn *WebhookNotifier) Add(webhook *Webhook, persistent bool) (*Webhook, error) {
+	if err := webhook.validate(); err != nil {
+		return nil, err
+	}
+
+	if webhook.Id == "" {
+		id, err := newWebhookId()
+		if err != nil {
+			return nil, err
+		}
+		webhook.Id = id
+	}
+
+	wn.mutex.Lock()
+	defer wn.mutex.Unlock()
+
+	if _, ok := wn.workers[webhook.Id]; ok {
+		return nil, fmt.Errorf("Webhook %v already exists", webhook.Id)
+	}
+
+	worker := &webhookWorker{
+		webhook:    webhook,
+		persistent: persistent,
+		queue:      make(chan *Event, webhookQueueSize),
+		stopChan:   make(chan bool),
+	}
+	wn.workers[webhook.Id] = worker
+	go wn.run(worker)
+
+	if persistent {
+		wn.save()
+	}
+	return webhook, nil
+}
+
+func (wn *WebhookNotifier) Remove(id string) bool {
+	wn.mutex.Lock()
+	defer wn.mutex.Unlock()
+
+	worker, ok := wn.workers[id]
+	if !ok {
+		return false
+	}
+
+	delete(wn.workers, id)
+	close(worker.stopChan)
+	if worker.persistent {
+		wn.save()
+	}
+	return true
+}
+
+// List returns the webhooks without their secrets.
+func (wn *WebhookNotifier) List() []*Webhook {
+	wn.mutex.Lock()
+	defer wn.mutex.Unlock()
+
+	result := make([]*Webhook, 0, len(wn.workers))
+	for _, worker := range wn.workers {
+		webhook := *worker.webhook
+		webhook.Secret = ""
+		result = append(result, &webhook)
+	}
+	sort.Sort(byWebhookId(result))
+	return result
+}
+
+func (wn *WebhookNotifier) HandleEvent(event *Event) {
+	wn.mutex.Lock()
+	defer wn.mutex.Unlock()
+
+	for _, worker := range wn.workers {
+		if !worker.webhook.accepts(event.Type) {
+			continue
+		}
+		select {
+		case worker.queue <- event:
+		default:
+			log.Printf("[scrapmagnet] Webhook %v queue full, dropping %v", worker.webhook.Id, event.Type)
+		}
+	}
+}
+
+func (wn *WebhookNotifier) run(worker *webhookWorker) {
+	for {
+		select {
+		case <-worker.stopChan:
+			return
+		case event := <-worker.queue:
+			wn.deliver(worker, event)
+		}
+	}
+}
+
+// deliver retries with an exponential backoff until the receiver answers
+// with a 2xx, or a 4xx telling retrying is pointless.
+func (wn *WebhookNotifier) deliver(worker *webhookWorker, event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	deliveryId, err := newWebhookId()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		retry, err := wn.post(worker.webhook, event.Type, deliveryId, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookMaxAttempts {
+			log.Printf("[scrapmagnet] Webhook %v failed to deliver %v: %v", worker.webhook.Id, event.Type, err)
+			return
+		}
+
+		select {
+		case <-worker.stopChan:
+			return
+		case <-time.After(webhookRetryDelay * time.Duration(1<<uint(attempt-1))):
+		}
+	}
+}
+
+func (wn *WebhookNotifier) post(webhook *Webhook, eventType string, deliveryId string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "scrapmagnet")
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookDeliveryHeader, deliveryId)
+	if signature := webhook.sign(body); signature != "" {
+		req.Header.Set(webhookSignatureHeader, signature)
+	}
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("Webhook returned %v", resp.Status)
+	default:
+		return false, fmt.Errorf("Webhook returned %v", resp.Status)
+	}
+}
+
+type byWebhookId []*Webhook
+
+func (s byWebhookId) Len() int           { return len(s) }
+func (s byWebhookId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byWebhookId) Less(i, j int) bool { return s[i].Id < s[j].Id }